@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const headerAPIKey = "X-API-Key"
+
+// Context keys set for callers that authenticated with an API key
+const (
+	ctxScopes   = "scopes"
+	ctxAPIKeyID = "api_key_id"
+)
+
+// apiKeyVerifyPath resolves API keys on the identity service.
+const apiKeyVerifyPath = "/internal/api-keys/verify"
+
+// Verified keys are cached so user-service is not consulted on every
+// request. A revoked key keeps working for at most apiKeyCacheTTL.
+const (
+	apiKeyCacheTTL    = time.Minute
+	apiKeyNegativeTTL = 10 * time.Second
+	apiKeyCacheSize   = 10000
+)
+
+// validScopes mirrors the scopes user-service grants to API keys.
+var validScopes = map[string]bool{
+	"users:read":          true,
+	"tasks:read":          true,
+	"tasks:write":         true,
+	"assignments:read":    true,
+	"assignments:write":   true,
+	"notifications:read":  true,
+	"notifications:write": true,
+	"dashboard:read":      true,
+}
+
+// apiKeyIdentity is the owner and permissions of a verified key.
+type apiKeyIdentity struct {
+	KeyID  int64    `json:"key_id"`
+	UserID int64    `json:"user_id"`
+	Roles  []string `json:"roles"`
+	Scopes []string `json:"scopes"`
+	// EmailVerified reports whether the owner has verified their email
+	EmailVerified bool `json:"email_verified"`
+}
+
+// apiKeyCache maps key hashes to verification results. A nil identity
+// records a rejected key.
+type apiKeyCache struct {
+	mu      sync.Mutex
+	entries map[string]apiKeyEntry
+}
+
+type apiKeyEntry struct {
+	identity *apiKeyIdentity
+	expires  time.Time
+}
+
+func (kc *apiKeyCache) get(hash string) (*apiKeyIdentity, bool) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	entry, ok := kc.entries[hash]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.identity, true
+}
+
+func (kc *apiKeyCache) put(hash string, identity *apiKeyIdentity) {
+	ttl := apiKeyCacheTTL
+	if identity == nil {
+		ttl = apiKeyNegativeTTL
+	}
+
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	if kc.entries == nil {
+		kc.entries = map[string]apiKeyEntry{}
+	}
+	if len(kc.entries) >= apiKeyCacheSize {
+		now := time.Now()
+		for h, entry := range kc.entries {
+			if now.After(entry.expires) {
+				delete(kc.entries, h)
+			}
+		}
+	}
+	if len(kc.entries) < apiKeyCacheSize {
+		kc.entries[hash] = apiKeyEntry{identity: identity, expires: time.Now().Add(ttl)}
+	}
+}
+
+// authenticateAPIKey verifies a key presented in the X-API-Key header and
+// sets the owner's identity along with the key's scopes.
+func (g *APIGateway) authenticateAPIKey(c *gin.Context, key string) bool {
+	sum := sha256.Sum256([]byte(key))
+	hash := hex.EncodeToString(sum[:])
+
+	identity, ok := g.apiKeys.get(hash)
+	if !ok {
+		var err error
+		identity, err = g.verifyAPIKey(c.Request.Context(), key)
+		if err != nil {
+			slog.Error("api key verification failed",
+				"request_id", c.GetString(ctxRequestID),
+				"error", err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Authentication service unavailable"})
+			c.Abort()
+			return false
+		}
+		g.apiKeys.put(hash, identity)
+	}
+
+	if identity == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+		c.Abort()
+		return false
+	}
+
+	c.Set(ctxScopes, identity.Scopes)
+	c.Set(ctxAPIKeyID, identity.KeyID)
+	g.setIdentity(c, identity.UserID, identity.Roles, identity.EmailVerified)
+	return true
+}
+
+// verifyAPIKey asks user-service to resolve a key. It returns a nil identity
+// when the key is unknown or revoked.
+func (g *APIGateway) verifyAPIKey(ctx context.Context, key string) (*apiKeyIdentity, error) {
+	g.mu.RLock()
+	u := g.services[identityService]
+	g.mu.RUnlock()
+	if u == nil {
+		return nil, fmt.Errorf("service %q is not configured", identityService)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	body, _ := json.Marshal(map[string]string{"key": key})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+u.name+apiKeyVerifyPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := u.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var identity apiKeyIdentity
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&identity); err != nil {
+		return nil, err
+	}
+	if identity.UserID <= 0 {
+		return nil, fmt.Errorf("invalid identity for key %d", identity.KeyID)
+	}
+	return &identity, nil
+}
+
+// hasScopes reports whether granted includes every scope in required.
+func hasScopes(granted, required []string) bool {
+	for _, r := range required {
+		found := false
+		for _, g := range granted {
+			if g == r {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const batchPath = "/api/batch"
+
+// batchConcurrency bounds the sub-requests of a parallel batch in flight.
+const batchConcurrency = 4
+
+// maxBatchResponseBody is the largest sub-response body kept; longer ones are
+// replaced by an error.
+const maxBatchResponseBody = 1 << 20
+
+const maxBatchBodyBytes = 1 << 20
+
+// BatchConfig enables POST /api/batch, which runs several requests in one
+// call. Each sub-request goes through the router like a separate request, so
+// authentication, authorization and rate limits apply to it unchanged.
+type BatchConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// RateLimit names an entry in rate_limits (defaults to "default" when
+	// defined). Each batch takes one token, on top of the tokens its
+	// sub-requests take on their own routes.
+	RateLimit   string `yaml:"rate_limit"`
+	MaxRequests int    `yaml:"max_requests"`
+
+	limit *RateLimit
+}
+
+func (c BatchConfig) withDefaults() BatchConfig {
+	if c.MaxRequests == 0 {
+		c.MaxRequests = 20
+	}
+	return c
+}
+
+func (c BatchConfig) validate() []error {
+	if !c.Enabled {
+		return nil
+	}
+	var errs []error
+	if c.RateLimit != "" && c.limit == nil {
+		errs = append(errs, fmt.Errorf("batch: unknown rate limit %q", c.RateLimit))
+	}
+	if c.MaxRequests < 1 {
+		errs = append(errs, errors.New("batch: max_requests must be positive"))
+	}
+	return errs
+}
+
+type batchRequest struct {
+	// Sequential runs the steps in order and skips the rest after the first
+	// failure. Later steps may refer to earlier responses, e.g.
+	// {{create.body.id}}.
+	Sequential bool        `json:"sequential"`
+	Requests   []batchStep `json:"requests" binding:"required,min=1"`
+}
+
+type batchStep struct {
+	ID      string            `json:"id"`
+	Method  string            `json:"method" binding:"required"`
+	Path    string            `json:"path" binding:"required"`
+	Headers map[string]string `json:"headers"`
+	Body    json.RawMessage   `json:"body"`
+}
+
+type batchResult struct {
+	ID      string            `json:"id"`
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    json.RawMessage   `json:"body,omitempty"`
+}
+
+func (r batchResult) failed() bool {
+	return r.Status >= http.StatusBadRequest
+}
+
+var batchMethods = map[string]bool{
+	http.MethodGet: true, http.MethodPost: true, http.MethodPut: true,
+	http.MethodPatch: true, http.MethodDelete: true,
+}
+
+// Client headers passed on to every sub-request. Steps cannot set these
+// themselves.
+var batchForwardHeaders = []string{"Authorization", headerAPIKey, "X-Forwarded-For", "X-Real-IP", "User-Agent"}
+
+type batchKey struct{}
+
+// inBatch reports whether the request is a sub-request of a batch.
+func inBatch(r *http.Request) bool {
+	return r.Context().Value(batchKey{}) != nil
+}
+
+// serveBatch runs the sub-requests of a batch through router and returns
+// their responses in order.
+func (g *APIGateway) serveBatch(cfg BatchConfig, router http.Handler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, h := range identityHeaders {
+			c.Request.Header.Del(h)
+		}
+		if cfg.limit != nil && !g.rateLimitIP(c, cfg.RateLimit, *cfg.limit) {
+			return
+		}
+		// Credentials are checked once up front so anonymous callers cannot
+		// fan out requests; every step is still authorized on its own route.
+		if !g.authenticateRequest(c) {
+			return
+		}
+		if cfg.limit != nil && !g.rateLimitUser(c, cfg.RateLimit, *cfg.limit) {
+			return
+		}
+
+		var req batchRequest
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBatchBodyBytes)
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if len(req.Requests) > cfg.MaxRequests {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d requests are allowed per batch", cfg.MaxRequests)})
+			return
+		}
+		ids := map[string]bool{}
+		for i := range req.Requests {
+			step := &req.Requests[i]
+			if step.ID == "" {
+				step.ID = strconv.Itoa(i)
+			}
+			if ids[step.ID] {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Duplicate request id: " + step.ID})
+				return
+			}
+			ids[step.ID] = true
+		}
+
+		b := &batch{
+			parent:  c.Request,
+			router:  router,
+			results: make([]batchResult, len(req.Requests)),
+			byID:    map[string]*batchResult{},
+		}
+		if req.Sequential {
+			b.runSequential(req.Requests)
+		} else {
+			b.runParallel(req.Requests)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"responses": b.results})
+	}
+}
+
+type batch struct {
+	parent  *http.Request
+	router  http.Handler
+	results []batchResult
+	byID    map[string]*batchResult // completed steps, for references
+}
+
+func (b *batch) runSequential(steps []batchStep) {
+	for i, step := range steps {
+		result := b.run(i, step, true)
+		b.results[i] = result
+		b.byID[step.ID] = &b.results[i]
+
+		if result.failed() {
+			for j := i + 1; j < len(steps); j++ {
+				b.results[j] = errorResult(steps[j].ID, http.StatusFailedDependency, "Skipped after step "+step.ID+" failed")
+			}
+			return
+		}
+	}
+}
+
+func (b *batch) runParallel(steps []batchStep) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, batchConcurrency)
+	for i, step := range steps {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			b.results[i] = b.run(i, step, false)
+		}()
+	}
+	wg.Wait()
+}
+
+// run dispatches one step and records its response.
+func (b *batch) run(i int, step batchStep, resolve bool) batchResult {
+	method := strings.ToUpper(step.Method)
+	if !batchMethods[method] {
+		return errorResult(step.ID, http.StatusBadRequest, "Unsupported method: "+step.Method)
+	}
+
+	path, body := step.Path, step.Body
+	if resolve {
+		var err error
+		if path, err = b.resolvePath(path); err == nil {
+			body, err = b.resolveBody(body)
+		}
+		if err != nil {
+			return errorResult(step.ID, http.StatusBadRequest, err.Error())
+		}
+	}
+
+	target, err := url.Parse(path)
+	if err != nil || target.Scheme != "" || target.Host != "" || !strings.HasPrefix(target.Path, "/") {
+		return errorResult(step.ID, http.StatusBadRequest, "Invalid path: "+path)
+	}
+	if target.Path == batchPath {
+		return errorResult(step.ID, http.StatusBadRequest, "Batches cannot be nested")
+	}
+
+	ctx := context.WithValue(b.parent.Context(), batchKey{}, true)
+	sub, err := http.NewRequestWithContext(ctx, method, target.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		return errorResult(step.ID, http.StatusBadRequest, "Invalid request: "+err.Error())
+	}
+	sub.RemoteAddr = b.parent.RemoteAddr
+	sub.Host = b.parent.Host
+	if len(body) > 0 {
+		sub.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range step.Headers {
+		sub.Header.Set(k, v)
+	}
+	for _, h := range batchForwardHeaders {
+		sub.Header.Del(h)
+		if v := b.parent.Header.Get(h); v != "" {
+			sub.Header.Set(h, v)
+		}
+	}
+	sub.Header.Set(headerRequestID, b.parent.Header.Get(headerRequestID)+"-"+strconv.Itoa(i))
+
+	rec := &batchRecorder{header: http.Header{}}
+	b.router.ServeHTTP(rec, sub)
+
+	if rec.overflow {
+		return errorResult(step.ID, http.StatusBadGateway, "Response too large for a batch")
+	}
+	result := batchResult{ID: step.ID, Status: rec.status(), Headers: map[string]string{}}
+	for k := range rec.header {
+		result.Headers[k] = rec.header.Get(k)
+	}
+	if rec.body.Len() > 0 {
+		if json.Valid(rec.body.Bytes()) {
+			result.Body = rec.body.Bytes()
+		} else {
+			result.Body, _ = json.Marshal(rec.body.String())
+		}
+	}
+	return result
+}
+
+func errorResult(id string, status int, message string) batchResult {
+	body, _ := json.Marshal(gin.H{"error": message})
+	return batchResult{ID: id, Status: status, Body: body}
+}
+
+// batchRef matches {{<step id>.status}} and {{<step id>.body.<field>...}}.
+var batchRef = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_-]+)\.(status|body(?:\.[A-Za-z0-9_-]+)*)\s*\}\}`)
+
+// lookup returns the value a reference points at in a completed step.
+func (b *batch) lookup(ref string) (any, error) {
+	m := batchRef.FindStringSubmatch(ref)
+	result, ok := b.byID[m[1]]
+	if !ok {
+		return nil, fmt.Errorf("reference %s: no earlier step %q", ref, m[1])
+	}
+	if m[2] == "status" {
+		return result.Status, nil
+	}
+
+	var value any
+	dec := json.NewDecoder(bytes.NewReader(result.Body))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil {
+		return nil, fmt.Errorf("reference %s: response body is not JSON", ref)
+	}
+	for _, key := range strings.Split(m[2], ".")[1:] {
+		switch v := value.(type) {
+		case map[string]any:
+			value, ok = v[key]
+		case []any:
+			n, err := strconv.Atoi(key)
+			ok = err == nil && n >= 0 && n < len(v)
+			if ok {
+				value = v[n]
+			}
+		default:
+			ok = false
+		}
+		if !ok {
+			return nil, fmt.Errorf("reference %s: no such field", ref)
+		}
+	}
+	return value, nil
+}
+
+// resolvePath substitutes references in a path, escaping each value.
+func (b *batch) resolvePath(path string) (string, error) {
+	var firstErr error
+	out := batchRef.ReplaceAllStringFunc(path, func(ref string) string {
+		value, err := b.lookup(ref)
+		if err != nil {
+			firstErr = cmpOr(firstErr, err)
+			return ref
+		}
+		return url.PathEscape(refString(value))
+	})
+	return out, firstErr
+}
+
+// resolveBody substitutes references in the string values of a JSON body. A
+// string that is a single reference takes the referenced value with its JSON
+// type, so {"task_id": "{{create.body.id}}"} sends a number.
+func (b *batch) resolveBody(body json.RawMessage) (json.RawMessage, error) {
+	if len(body) == 0 || !batchRef.Match(body) {
+		return body, nil
+	}
+
+	var doc any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid body: %w", err)
+	}
+
+	var firstErr error
+	var walk func(v any) any
+	walk = func(v any) any {
+		switch v := v.(type) {
+		case map[string]any:
+			for k, item := range v {
+				v[k] = walk(item)
+			}
+		case []any:
+			for i, item := range v {
+				v[i] = walk(item)
+			}
+		case string:
+			if loc := batchRef.FindStringIndex(v); loc != nil && loc[0] == 0 && loc[1] == len(v) {
+				value, err := b.lookup(v)
+				if err != nil {
+					firstErr = cmpOr(firstErr, err)
+					return v
+				}
+				return value
+			}
+			return batchRef.ReplaceAllStringFunc(v, func(ref string) string {
+				value, err := b.lookup(ref)
+				if err != nil {
+					firstErr = cmpOr(firstErr, err)
+					return ref
+				}
+				return refString(value)
+			})
+		}
+		return v
+	}
+	doc = walk(doc)
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return json.Marshal(doc)
+}
+
+func refString(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	default:
+		out, _ := json.Marshal(v)
+		return string(out)
+	}
+}
+
+func cmpOr(err, next error) error {
+	if err != nil {
+		return err
+	}
+	return next
+}
+
+// batchRecorder captures a sub-response in memory.
+type batchRecorder struct {
+	header   http.Header
+	code     int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (r *batchRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *batchRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+}
+
+func (r *batchRecorder) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	if r.body.Len()+len(p) > maxBatchResponseBody {
+		r.overflow = true
+		return 0, errors.New("batch response body too large")
+	}
+	return r.body.Write(p)
+}
+
+// Flush is a no-op; the proxy flushes periodically and gin expects the
+// underlying writer to support it.
+func (r *batchRecorder) Flush() {}
+
+func (r *batchRecorder) status() int {
+	if r.code == 0 {
+		return http.StatusOK
+	}
+	return r.code
+}
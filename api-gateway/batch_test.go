@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func testBatch() *batch {
+	return &batch{byID: map[string]*batchResult{
+		"create": {ID: "create", Status: 201, Body: json.RawMessage(`{"id":42,"title":"a b/c","tags":["x","y"],"owner":{"id":7}}`)},
+		"text":   {ID: "text", Status: 200, Body: json.RawMessage(`not json`)},
+	}}
+}
+
+func TestBatchResolvePath(t *testing.T) {
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"/api/tasks/{{create.body.id}}", "/api/tasks/42", false},
+		{"/api/tasks/{{ create.body.id }}/x", "/api/tasks/42/x", false},
+		{"/api/search/{{create.body.title}}", "/api/search/a%20b%2Fc", false},
+		{"/api/users/{{create.body.owner.id}}", "/api/users/7", false},
+		{"/api/tags/{{create.body.tags.1}}", "/api/tags/y", false},
+		{"/api/status/{{create.status}}", "/api/status/201", false},
+		{"/api/tasks/{{missing.body.id}}", "", true},
+		{"/api/tasks/{{create.body.nope}}", "", true},
+		{"/api/tasks/{{create.body.tags.5}}", "", true},
+		{"/api/tasks/{{text.body.id}}", "", true},
+		{"/api/tasks/1", "/api/tasks/1", false},
+	}
+	b := testBatch()
+	for _, tt := range tests {
+		got, err := b.resolvePath(tt.path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("resolvePath(%q) error = %v, want error %v", tt.path, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("resolvePath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestBatchResolveBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    string
+		wantErr bool
+	}{
+		{"keeps number type", `{"task_id":"{{create.body.id}}"}`, `{"task_id":42}`, false},
+		{"keeps object type", `{"owner":"{{create.body.owner}}"}`, `{"owner":{"id":7}}`, false},
+		{"interpolates into string", `{"note":"task {{create.body.id}} by {{create.body.owner.id}}"}`, `{"note":"task 42 by 7"}`, false},
+		{"nested values", `{"items":[{"id":"{{create.body.id}}"}]}`, `{"items":[{"id":42}]}`, false},
+		{"no references", `{"title":"x"}`, `{"title":"x"}`, false},
+		{"unknown step", `{"id":"{{missing.body.id}}"}`, "", true},
+		{"invalid JSON", `{"id":"{{create.body.id}}"`, "", true},
+	}
+	b := testBatch()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := b.resolveBody(json.RawMessage(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(got) != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// batchRouter serves /api/batch and authenticated task routes proxied to h.
+// It returns a token for user 7 that the router accepts.
+func batchRouter(t *testing.T, h http.Handler, cfg BatchConfig, routeLimit *RateLimit) (*gin.Engine, string) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &APIGateway{limiter: &memoryRateLimiter{buckets: map[string]*bucket{}}}
+	g.jwks.keys = map[string]verificationKey{"test": {alg: "EdDSA", public: pub}}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.MapClaims{
+		"user_id": 7,
+		"jti":     "test",
+		"iat":     now.Unix(),
+		"exp":     now.Add(5 * time.Minute).Unix(),
+	})
+	token.Header["kid"] = "test"
+	signed, err := token.SignedString(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := newTestUpstream(t, h, nil)
+	r := gin.New()
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		route := RouteConfig{Method: method, Path: "/api/tasks/:id", Service: "test", Auth: true}
+		if routeLimit != nil {
+			route.RateLimit, route.limit = "tasks", routeLimit
+		}
+		r.Handle(method, route.Path, g.proxyRequest(route, u))
+	}
+	r.POST(batchPath, g.serveBatch(cfg.withDefaults(), r))
+	return r, signed
+}
+
+func batchCall(r http.Handler, token, body string) (*httptest.ResponseRecorder, []batchResult) {
+	// Like a server request, the context can be cancelled; the proxy would
+	// otherwise ask the sub-request recorder for CloseNotify
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := httptest.NewRequest(http.MethodPost, batchPath, strings.NewReader(body)).WithContext(ctx)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := doRequest(r, req)
+
+	var resp struct {
+		Responses []batchResult `json:"responses"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w, resp.Responses
+}
+
+func batchStatuses(results []batchResult) []int {
+	statuses := make([]int, len(results))
+	for i, result := range results {
+		statuses[i] = result.Status
+	}
+	return statuses
+}
+
+// tasksHandler answers /api/tasks/<id> with 404 for id "missing" and echoes
+// the forwarded caller otherwise.
+func tasksHandler(hits *atomic.Int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/missing") {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"Task not found"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"user_id":       r.Header.Get(headerUserID),
+			"authorization": r.Header.Get("Authorization"),
+		})
+	})
+}
+
+func TestBatchSequentialStopsOnFailure(t *testing.T) {
+	var hits atomic.Int32
+	r, token := batchRouter(t, tasksHandler(&hits), BatchConfig{Enabled: true}, nil)
+
+	w, results := batchCall(r, token, `{"sequential":true,"requests":[
+		{"method":"GET","path":"/api/tasks/1"},
+		{"method":"GET","path":"/api/tasks/missing"},
+		{"method":"POST","path":"/api/tasks/2","body":{}}
+	]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+	got := batchStatuses(results)
+	want := []int{http.StatusOK, http.StatusNotFound, http.StatusFailedDependency}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("statuses = %v, want %v", got, want)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("upstream hits = %d, want 2", n)
+	}
+}
+
+func TestBatchAuthentication(t *testing.T) {
+	var hits atomic.Int32
+	r, token := batchRouter(t, tasksHandler(&hits), BatchConfig{Enabled: true}, nil)
+	body := `{"requests":[
+		{"method":"GET","path":"/api/tasks/1"},
+		{"method":"GET","path":"/api/tasks/2","headers":{"Authorization":"Bearer forged","X-User-ID":"1"}}
+	]}`
+
+	t.Run("sub-requests act as the caller", func(t *testing.T) {
+		w, results := batchCall(r, token, body)
+		if w.Code != http.StatusOK || len(results) != 2 {
+			t.Fatalf("status = %d, want 200 with 2 responses: %s", w.Code, w.Body)
+		}
+		for _, result := range results {
+			var got map[string]string
+			json.Unmarshal(result.Body, &got)
+			if result.Status != http.StatusOK || got["user_id"] != "7" {
+				t.Errorf("step %s: status %d, upstream saw user %q, want 200 and user 7", result.ID, result.Status, got["user_id"])
+			}
+		}
+	})
+
+	t.Run("anonymous batch is rejected", func(t *testing.T) {
+		hits.Store(0)
+		if w, _ := batchCall(r, "", body); w.Code != http.StatusUnauthorized {
+			t.Errorf("status = %d, want 401", w.Code)
+		}
+		if n := hits.Load(); n != 0 {
+			t.Errorf("upstream hits = %d, want 0", n)
+		}
+	})
+}
+
+func TestBatchSizeLimits(t *testing.T) {
+	var hits atomic.Int32
+	r, token := batchRouter(t, tasksHandler(&hits), BatchConfig{Enabled: true, MaxRequests: 2}, nil)
+
+	step := `{"method":"GET","path":"/api/tasks/1"}`
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"too many requests", `{"requests":[` + strings.Repeat(step+",", 2) + step + `]}`},
+		{"body too large", `{"requests":[{"method":"POST","path":"/api/tasks/1","body":{"title":"` + strings.Repeat("x", maxBatchBodyBytes) + `"}}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w, _ := batchCall(r, token, tt.body); w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400", w.Code)
+			}
+		})
+	}
+	if n := hits.Load(); n != 0 {
+		t.Errorf("upstream hits = %d, want 0", n)
+	}
+}
+
+// A batch takes a token from its own limit, and each sub-request one from
+// the limit of its route.
+func TestBatchRateLimit(t *testing.T) {
+	var hits atomic.Int32
+	batchLimit := RateLimit{Requests: 2, Per: time.Minute}
+	routeLimit := RateLimit{Requests: 3, Per: time.Minute}
+	cfg := BatchConfig{Enabled: true, RateLimit: "batch", limit: &batchLimit}
+	r, token := batchRouter(t, tasksHandler(&hits), cfg, &routeLimit)
+
+	body := `{"requests":[{"method":"GET","path":"/api/tasks/1"},{"method":"GET","path":"/api/tasks/2"}]}`
+	_, first := batchCall(r, token, body)
+	_, second := batchCall(r, token, body)
+	third, _ := batchCall(r, token, body)
+
+	if got := batchStatuses(first); len(got) != 2 || got[0] != http.StatusOK || got[1] != http.StatusOK {
+		t.Errorf("first batch statuses = %v, want [200 200]", got)
+	}
+	limited := 0
+	for _, status := range batchStatuses(second) {
+		if status == http.StatusTooManyRequests {
+			limited++
+		}
+	}
+	if limited != 1 {
+		t.Errorf("second batch statuses = %v, want one 429", batchStatuses(second))
+	}
+	if third.Code != http.StatusTooManyRequests {
+		t.Errorf("third batch status = %d, want 429", third.Code)
+	}
+	if n := hits.Load(); n != 3 {
+		t.Errorf("upstream hits = %d, want 3", n)
+	}
+}
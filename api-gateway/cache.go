@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// headerCacheInvalidate lists the cache tags a service's response makes
+// stale, e.g. "tasks, assignments". Only successful responses count, and the
+// header never reaches the client.
+const headerCacheInvalidate = "X-Cache-Invalidate"
+
+const (
+	// maxCacheEntries bounds the cache; the least recently used entry goes
+	// first.
+	maxCacheEntries = 10000
+	// maxCacheBody is the largest response body cached.
+	maxCacheBody = 1 << 20
+)
+
+// cacheInvalidateChannel carries invalidated tags between gateway replicas.
+const cacheInvalidateChannel = "gateway:cache:invalidate"
+
+// CacheConfig caches a GET route's successful responses per user.
+type CacheConfig struct {
+	// TTL bounds how long a response is served from the cache. A shorter
+	// max-age from the upstream wins.
+	TTL time.Duration `yaml:"ttl"`
+	// Tags name the data the response depends on. Responses carrying one of
+	// them in X-Cache-Invalidate drop the entry. Defaults to the service.
+	Tags []string `yaml:"tags"`
+}
+
+// Response headers not replayed from the cache; they describe the original
+// exchange rather than the content.
+var uncachedHeaders = []string{"Date", "Age", "Content-Length", "Connection", "Transfer-Encoding", headerRequestID}
+
+type cacheEntry struct {
+	key     string
+	tags    []string
+	status  int
+	header  http.Header
+	body    []byte
+	etag    string
+	stored  time.Time
+	expires time.Time
+}
+
+// responseCache holds responses in memory. With Redis configured,
+// invalidations are relayed to the other gateway replicas.
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element // of *cacheEntry, most recent in front
+	lru     *list.List
+	tagged  map[string]map[string]bool // tag -> keys
+	// generations counts the invalidations of each tag, so a response
+	// fetched before one is not stored after it.
+	generations map[string]uint64
+
+	client *redis.Client
+}
+
+// newResponseCache shares invalidations through Redis when REDIS_URL is set.
+func newResponseCache(redisURL string) (*responseCache, error) {
+	c := &responseCache{
+		entries:     map[string]*list.Element{},
+		lru:         list.New(),
+		tagged:      map[string]map[string]bool{},
+		generations: map[string]uint64{},
+	}
+	if redisURL == "" {
+		return c, nil
+	}
+
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse REDIS_URL: %w", err)
+	}
+	c.client = redis.NewClient(opts)
+	return c, nil
+}
+
+func (c *responseCache) Close() error {
+	if c.client == nil {
+		return nil
+	}
+	return c.client.Close()
+}
+
+func (c *responseCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		c.remove(el)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return e
+}
+
+// generation returns the invalidation counts of tags, to be passed to put.
+func (c *responseCache) generation(tags []string) []uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	gens := make([]uint64, len(tags))
+	for i, tag := range tags {
+		gens[i] = c.generations[tag]
+	}
+	return gens
+}
+
+// put stores e unless one of its tags was invalidated since gens were taken
+// from generation, in which case e may hold data from before a write.
+func (c *responseCache) put(e *cacheEntry, gens []uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, tag := range e.tags {
+		if c.generations[tag] != gens[i] {
+			return
+		}
+	}
+
+	if el, ok := c.entries[e.key]; ok {
+		c.remove(el)
+	}
+	for c.lru.Len() >= maxCacheEntries {
+		c.remove(c.lru.Back())
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	for _, tag := range e.tags {
+		if c.tagged[tag] == nil {
+			c.tagged[tag] = map[string]bool{}
+		}
+		c.tagged[tag][e.key] = true
+	}
+}
+
+// remove drops an entry; c.mu must be held.
+func (c *responseCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	for _, tag := range e.tags {
+		delete(c.tagged[tag], e.key)
+		if len(c.tagged[tag]) == 0 {
+			delete(c.tagged, tag)
+		}
+	}
+}
+
+// invalidate drops every entry carrying one of tags on this replica.
+func (c *responseCache) invalidate(tags []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, tag := range tags {
+		c.generations[tag]++
+		for key := range c.tagged[tag] {
+			c.remove(c.entries[key])
+		}
+	}
+}
+
+// publish invalidates tags here and on the other replicas.
+func (c *responseCache) publish(ctx context.Context, tags []string) {
+	c.invalidate(tags)
+	if c.client == nil {
+		return
+	}
+	if err := c.client.Publish(ctx, cacheInvalidateChannel, strings.Join(tags, ",")).Err(); err != nil {
+		slog.Warn("cache invalidation not shared with other replicas", "tags", tags, "error", err)
+	}
+}
+
+// watchInvalidations applies invalidations published by other replicas. Its
+// own come back too and are dropped a second time, which is harmless.
+func (c *responseCache) watchInvalidations(ctx context.Context) {
+	if c.client == nil {
+		return
+	}
+	sub := c.client.Subscribe(ctx, cacheInvalidateChannel)
+	defer sub.Close()
+
+	ch := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			c.invalidate(strings.Split(msg.Payload, ","))
+		}
+	}
+}
+
+type cacheKey struct{}
+
+// cacheRequest is attached to a request whose response may be cached.
+type cacheRequest struct {
+	key         string
+	cfg         *CacheConfig
+	ifNoneMatch string
+	store       bool // false when the client sent no-store
+	// generations of cfg.Tags before the request went upstream
+	generations []uint64
+}
+
+// lookupCache answers a GET on a cached route from the cache. It returns
+// false when it has written the response; otherwise the request is marked
+// so its response is stored. It must run after authenticateRequest.
+func (g *APIGateway) lookupCache(c *gin.Context, route RouteConfig) bool {
+	userID, ok := c.Get(ctxUserID)
+	if !ok || c.Request.Method != http.MethodGet {
+		return true
+	}
+	key := fmt.Sprintf("user:%d %s %s", userID, route.Version, c.Request.URL.RequestURI())
+
+	directives := cacheDirectives(c.Request.Header)
+	_, noStore := directives["no-store"]
+	_, noCache := directives["no-cache"]
+	if maxAge, ok := directives["max-age"]; ok && maxAge == "0" {
+		noCache = true
+	}
+
+	if !noCache && !noStore {
+		if e := g.cache.get(key); e != nil {
+			h := c.Writer.Header()
+			for name, values := range e.header {
+				h[name] = values
+			}
+			h.Set("Age", strconv.Itoa(int(time.Since(e.stored).Seconds())))
+			h.Set("X-Cache", "HIT")
+			if etagMatches(c.GetHeader("If-None-Match"), e.etag) {
+				c.Status(http.StatusNotModified)
+				return false
+			}
+			c.Data(e.status, e.header.Get("Content-Type"), e.body)
+			return false
+		}
+	}
+
+	cr := &cacheRequest{
+		key:         key,
+		cfg:         route.Cache,
+		ifNoneMatch: c.GetHeader("If-None-Match"),
+		store:       !noStore,
+		generations: g.cache.generation(route.Cache.Tags),
+	}
+	// The upstream always sends the full body so it can be stored and tagged
+	c.Request.Header.Del("If-None-Match")
+	c.Request.Header.Del("If-Modified-Since")
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), cacheKey{}, cr))
+	return true
+}
+
+// cacheResponse tags a successful response with an ETag, stores it for
+// the route's TTL unless the upstream forbids it, and answers a matching
+// If-None-Match with 304. It runs as part of the proxy's ModifyResponse.
+func (u *upstream) cacheResponse(resp *http.Response) error {
+	cr, ok := resp.Request.Context().Value(cacheKey{}).(*cacheRequest)
+	if !ok || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCacheBody+1))
+	if err != nil {
+		resp.Body.Close()
+		return err
+	}
+	if len(data) > maxCacheBody {
+		// Too large to keep; pass it through untouched
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	resp.Header.Set("ETag", etag)
+	resp.Header.Set("X-Cache", "MISS")
+
+	ttl := cr.cfg.TTL
+	directives := cacheDirectives(resp.Header)
+	_, noStore := directives["no-store"]
+	_, noCache := directives["no-cache"]
+	if maxAge, err := strconv.Atoi(directives["max-age"]); err == nil && time.Duration(maxAge)*time.Second < ttl {
+		ttl = time.Duration(maxAge) * time.Second
+	}
+	if len(directives) == 0 {
+		// Per-user content: browsers may keep it but must revalidate
+		resp.Header.Set("Cache-Control", "private, no-cache")
+	}
+
+	if cr.store && !noStore && !noCache && ttl > 0 && resp.Header.Get("Set-Cookie") == "" {
+		header := resp.Header.Clone()
+		for _, name := range append(uncachedHeaders, "X-Cache") {
+			header.Del(name)
+		}
+		now := time.Now()
+		u.cache.put(&cacheEntry{
+			key:     cr.key,
+			tags:    cr.cfg.Tags,
+			status:  resp.StatusCode,
+			header:  header,
+			body:    data,
+			etag:    etag,
+			stored:  now,
+			expires: now.Add(ttl),
+		}, cr.generations)
+	}
+
+	if etagMatches(cr.ifNoneMatch, etag) {
+		resp.StatusCode = http.StatusNotModified
+		resp.Status = http.StatusText(http.StatusNotModified)
+		resp.Header.Del("Content-Type")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = 0
+		resp.Body = http.NoBody
+		return nil
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = int64(len(data))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	return nil
+}
+
+// invalidateCache drops the entries for the tags a successful response
+// names in X-Cache-Invalidate.
+func (u *upstream) invalidateCache(resp *http.Response) {
+	raw := resp.Header.Values(headerCacheInvalidate)
+	resp.Header.Del(headerCacheInvalidate)
+	if len(raw) == 0 || resp.StatusCode >= http.StatusBadRequest {
+		return
+	}
+
+	var tags []string
+	for _, v := range raw {
+		for _, tag := range strings.Split(v, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	if len(tags) > 0 {
+		u.cache.publish(context.WithoutCancel(resp.Request.Context()), tags)
+	}
+}
+
+// cacheDirectives parses a Cache-Control header into directive -> value.
+func cacheDirectives(h http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// etagMatches implements the weak comparison If-None-Match uses.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (c CacheConfig) validate() error {
+	if c.TTL <= 0 {
+		return errors.New("cache ttl must be positive")
+	}
+	for _, tag := range c.Tags {
+		if tag == "" || strings.ContainsAny(tag, ", ") {
+			return fmt.Errorf("invalid cache tag %q", tag)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var testCacheRoute = RouteConfig{
+	Method: http.MethodGet,
+	Path:   "/api/tasks",
+	Auth:   true,
+	Cache:  &CacheConfig{TTL: time.Minute, Tags: []string{"tasks"}},
+}
+
+// cacheRouter proxies /api/tasks to u for user 7, caching GET responses in
+// cache.
+func cacheRouter(u *upstream, cache *responseCache) *gin.Engine {
+	g := &APIGateway{cache: cache}
+
+	r := gin.New()
+	r.GET("/api/tasks", func(c *gin.Context) {
+		c.Set(ctxUserID, int64(7))
+		if !g.lookupCache(c, testCacheRoute) {
+			return
+		}
+		u.proxy.ServeHTTP(c.Writer, c.Request)
+	})
+	r.POST("/api/tasks", func(c *gin.Context) {
+		c.Set(ctxUserID, int64(7))
+		u.proxy.ServeHTTP(c.Writer, c.Request)
+	})
+	return r
+}
+
+func cachedGet(header ...string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/api/tasks", nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	return req
+}
+
+func TestCacheLookup(t *testing.T) {
+	tests := []struct {
+		name           string
+		status         int
+		upstreamHeader []string
+		requestHeader  []string
+		wantHits       int32
+	}{
+		{"served from cache", http.StatusOK, nil, nil, 1},
+		{"client no-cache", http.StatusOK, nil, []string{"Cache-Control", "no-cache"}, 2},
+		{"client max-age=0", http.StatusOK, nil, []string{"Cache-Control", "max-age=0"}, 2},
+		{"client no-store", http.StatusOK, nil, []string{"Cache-Control", "no-store"}, 2},
+		{"upstream no-store", http.StatusOK, []string{"Cache-Control", "no-store"}, nil, 2},
+		{"upstream max-age=0", http.StatusOK, []string{"Cache-Control", "max-age=0"}, nil, 2},
+		{"upstream sets cookie", http.StatusOK, []string{"Set-Cookie", "a=b"}, nil, 2},
+		{"not found", http.StatusNotFound, nil, nil, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits atomic.Int32
+			cache := newTestCache(t)
+			u := newTestUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+				for i := 0; i+1 < len(tt.upstreamHeader); i += 2 {
+					w.Header().Set(tt.upstreamHeader[i], tt.upstreamHeader[i+1])
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				io.WriteString(w, `[{"id":1}]`)
+			}), cache)
+			r := cacheRouter(u, cache)
+
+			first := doRequest(r, cachedGet(tt.requestHeader...))
+			second := doRequest(r, cachedGet(tt.requestHeader...))
+
+			if got := hits.Load(); got != tt.wantHits {
+				t.Errorf("upstream hits = %d, want %d", got, tt.wantHits)
+			}
+			if second.Code != tt.status || second.Body.String() != `[{"id":1}]` {
+				t.Errorf("second response = %d %q", second.Code, second.Body.String())
+			}
+			wantCache := "MISS"
+			if tt.wantHits == 1 {
+				wantCache = "HIT"
+			}
+			if tt.status == http.StatusOK {
+				if got := second.Header().Get("X-Cache"); got != wantCache {
+					t.Errorf("X-Cache = %q, want %q", got, wantCache)
+				}
+				if first.Header().Get("ETag") == "" || second.Header().Get("ETag") != first.Header().Get("ETag") {
+					t.Errorf("ETag = %q then %q", first.Header().Get("ETag"), second.Header().Get("ETag"))
+				}
+			}
+		})
+	}
+}
+
+func TestCacheNotModified(t *testing.T) {
+	tests := []struct {
+		name        string
+		cached      bool
+		ifNoneMatch string
+		wantStatus  int
+	}{
+		{"cached match", true, "", http.StatusNotModified},
+		{"cached weak match", true, "W/", http.StatusNotModified},
+		{"cached mismatch", true, `"other"`, http.StatusOK},
+		{"uncached match", false, "", http.StatusNotModified},
+		{"uncached mismatch", false, `"other"`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits atomic.Int32
+			cache := newTestCache(t)
+			u := newTestUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+				if r.Header.Get("If-None-Match") != "" {
+					t.Error("If-None-Match passed upstream")
+				}
+				io.WriteString(w, `[{"id":1}]`)
+			}), cache)
+			r := cacheRouter(u, cache)
+
+			etag := doRequest(r, cachedGet("Cache-Control", "no-store")).Header().Get("ETag")
+			if tt.cached {
+				doRequest(r, cachedGet())
+			}
+			ifNoneMatch := tt.ifNoneMatch
+			if ifNoneMatch == "" || ifNoneMatch == "W/" {
+				ifNoneMatch += etag
+			}
+
+			w := doRequest(r, cachedGet("If-None-Match", ifNoneMatch))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusNotModified && w.Body.Len() != 0 {
+				t.Errorf("304 with body %q", w.Body.String())
+			}
+			// Cached responses are revalidated without the upstream
+			if got := hits.Load(); got != 2 {
+				t.Errorf("upstream hits = %d, want 2", got)
+			}
+		})
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		invalidate  string
+		wantRefetch bool
+	}{
+		{"route tag", http.StatusCreated, "tasks", true},
+		{"one of several tags", http.StatusCreated, "users, tasks", true},
+		{"other tag", http.StatusCreated, "users", false},
+		{"failed write", http.StatusBadRequest, "tasks", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reads atomic.Int32
+			cache := newTestCache(t)
+			u := newTestUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodPost {
+					w.Header().Set(headerCacheInvalidate, tt.invalidate)
+					w.WriteHeader(tt.status)
+					return
+				}
+				reads.Add(1)
+				io.WriteString(w, `[{"id":1}]`)
+			}), cache)
+			r := cacheRouter(u, cache)
+
+			doRequest(r, cachedGet())
+			write := doRequest(r, httptest.NewRequest(http.MethodPost, "/api/tasks", nil))
+			if write.Header().Get(headerCacheInvalidate) != "" {
+				t.Errorf("%s reached the client", headerCacheInvalidate)
+			}
+			doRequest(r, cachedGet())
+
+			if refetched := reads.Load() == 2; refetched != tt.wantRefetch {
+				t.Errorf("refetched = %v, want %v", refetched, tt.wantRefetch)
+			}
+		})
+	}
+}
+
+// A write that completes while a read is in flight invalidates before the
+// read's response, fetched before the write, reaches the cache. That
+// response must not be stored.
+func TestCacheInvalidatedDuringRequest(t *testing.T) {
+	var reads atomic.Int32
+	cache := newTestCache(t)
+	u := newTestUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if reads.Add(1) == 1 {
+			cache.invalidate([]string{"tasks"})
+			io.WriteString(w, `[]`)
+			return
+		}
+		io.WriteString(w, `[{"id":1}]`)
+	}), cache)
+	r := cacheRouter(u, cache)
+
+	doRequest(r, cachedGet())
+	w := doRequest(r, cachedGet())
+
+	if w.Body.String() != `[{"id":1}]` {
+		t.Errorf("body = %q, want the data written since", w.Body.String())
+	}
+	if got := reads.Load(); got != 2 {
+		t.Errorf("upstream reads = %d, want 2", got)
+	}
+
+	// Later responses are cached again
+	doRequest(r, cachedGet())
+	if got := reads.Load(); got != 2 {
+		t.Errorf("upstream reads = %d after the cache was refilled, want 2", got)
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// GatewayConfig is the declarative route table loaded from GATEWAY_CONFIG.
+// YAML and JSON files are both accepted.
+type GatewayConfig struct {
+	// TrustedProxies lists proxy IPs/CIDRs whose X-Forwarded-For is believed
+	// when resolving the client IP. Empty trusts none.
+	TrustedProxies []string                   `yaml:"trusted_proxies"`
+	CORS           CORSConfig                 `yaml:"cors"`
+	GraphQL        GraphQLConfig              `yaml:"graphql"`
+	Batch          BatchConfig                `yaml:"batch"`
+	Idempotency    IdempotencyConfig          `yaml:"idempotency"`
+	RateLimits     map[string]RateLimit       `yaml:"rate_limits"`
+	Transforms     map[string]TransformConfig `yaml:"transforms"`
+	Services       map[string]ServiceConfig   `yaml:"services"`
+	// Versions lists the API versions served under /api/<version>/.
+	// Without versions, routes are served at their configured paths only.
+	Versions       map[string]VersionConfig `yaml:"versions"`
+	DefaultVersion string                   `yaml:"default_version"`
+	Routes         []RouteConfig            `yaml:"routes"`
+
+	// endpoints are the routes as registered, one per version they serve
+	endpoints []RouteConfig
+}
+
+// defaultRateLimit applies to routes that do not name a rate limit group.
+const defaultRateLimit = "default"
+
+type ServiceConfig struct {
+	Name string `yaml:"-"`
+	// BaseURL and URLs list the service instances. Either may hold a
+	// comma-separated list after environment expansion.
+	BaseURL     string            `yaml:"url"`
+	URLs        []string          `yaml:"urls"`
+	Balancer    string            `yaml:"balancer"`
+	HealthCheck HealthCheckConfig `yaml:"health_check"`
+	Timeouts    TimeoutConfig     `yaml:"timeouts"`
+	Retries     RetryConfig       `yaml:"retries"`
+	Breaker     BreakerConfig     `yaml:"breaker"`
+}
+
+type HealthCheckConfig struct {
+	Disabled           bool          `yaml:"disabled"`
+	Path               string        `yaml:"path"`
+	Interval           time.Duration `yaml:"interval"`
+	Timeout            time.Duration `yaml:"timeout"`
+	HealthyThreshold   int           `yaml:"healthy_threshold"`
+	UnhealthyThreshold int           `yaml:"unhealthy_threshold"`
+}
+
+type TimeoutConfig struct {
+	Dial     time.Duration `yaml:"dial"`
+	Response time.Duration `yaml:"response"`
+}
+
+// RetryConfig applies to idempotent methods only. Attempts includes the
+// first try.
+type RetryConfig struct {
+	Attempts   int           `yaml:"attempts"`
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+type BreakerConfig struct {
+	FailureThreshold int           `yaml:"failure_threshold"`
+	OpenTimeout      time.Duration `yaml:"open_timeout"`
+}
+
+// withDefaults expands the instance list and fills unset upstream settings.
+func (s ServiceConfig) withDefaults() ServiceConfig {
+	var urls []string
+	for _, raw := range append(s.URLs, s.BaseURL) {
+		for _, u := range strings.Split(os.ExpandEnv(raw), ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				urls = append(urls, u)
+			}
+		}
+	}
+	s.URLs = urls
+
+	if s.Balancer == "" {
+		s.Balancer = balancerRoundRobin
+	}
+	if s.HealthCheck.Path == "" {
+		s.HealthCheck.Path = "/health"
+	}
+	if s.HealthCheck.Interval == 0 {
+		s.HealthCheck.Interval = 10 * time.Second
+	}
+	if s.HealthCheck.Timeout == 0 {
+		s.HealthCheck.Timeout = 2 * time.Second
+	}
+	if s.HealthCheck.HealthyThreshold == 0 {
+		s.HealthCheck.HealthyThreshold = 2
+	}
+	if s.HealthCheck.UnhealthyThreshold == 0 {
+		s.HealthCheck.UnhealthyThreshold = 3
+	}
+	if s.Timeouts.Dial == 0 {
+		s.Timeouts.Dial = 2 * time.Second
+	}
+	if s.Timeouts.Response == 0 {
+		s.Timeouts.Response = 8 * time.Second
+	}
+	if s.Retries.Attempts == 0 {
+		s.Retries.Attempts = 3
+	}
+	if s.Retries.Backoff == 0 {
+		s.Retries.Backoff = 100 * time.Millisecond
+	}
+	if s.Retries.MaxBackoff == 0 {
+		s.Retries.MaxBackoff = time.Second
+	}
+	if s.Breaker.FailureThreshold == 0 {
+		s.Breaker.FailureThreshold = 5
+	}
+	if s.Breaker.OpenTimeout == 0 {
+		s.Breaker.OpenTimeout = 30 * time.Second
+	}
+	return s
+}
+
+// RouteConfig maps a gateway path to an upstream service.
+type RouteConfig struct {
+	Method  string   `yaml:"method"`
+	Path    string   `yaml:"path"`
+	Service string   `yaml:"service"`
+	Auth    bool     `yaml:"auth"`
+	Roles   []string `yaml:"roles"`
+	// Scopes an API key must hold to call the route. Routes without scopes
+	// reject API keys. Ignored for JWT callers.
+	Scopes []string `yaml:"scopes"`
+	// RequireVerified rejects callers whose email address is not verified.
+	RequireVerified bool `yaml:"require_verified"`
+	// OwnerParam names a path parameter holding a user ID. Only that user
+	// and admins may call the route.
+	OwnerParam string `yaml:"owner_param"`
+	// QueryToken accepts the bearer token as ?access_token=, for pages a
+	// browser opens by navigation.
+	QueryToken bool `yaml:"query_token"`
+	// Rewrite is the upstream path template. Route parameters such as
+	// :user_id are substituted from the incoming path. Empty keeps the path.
+	Rewrite string `yaml:"rewrite"`
+	// RateLimit names an entry in rate_limits. Routes sharing a name share
+	// a bucket per caller.
+	RateLimit string `yaml:"rate_limit"`
+	// Transform names an entry in transforms applied to the route's
+	// requests and responses.
+	Transform string `yaml:"transform"`
+	// Cache stores successful responses of a GET route per user.
+	Cache *CacheConfig `yaml:"cache"`
+	// Version is the API version the route belongs to; empty means
+	// default_version.
+	Version string `yaml:"version"`
+	// Stream marks a Server-Sent Events or WebSocket route. The connection
+	// may stay open past the server timeouts and is closed after
+	// IdleTimeout without traffic in either direction.
+	Stream      bool          `yaml:"stream"`
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+
+	limit       *RateLimit
+	transform   *TransformConfig
+	idempotency *IdempotencyConfig // set on mutating routes when enabled
+
+	// Set on the copies registered per version
+	versionPrefix string         // /api/<version>, replaced by /api upstream
+	alias         bool           // unversioned path of the default version
+	lifecycle     *VersionConfig // deprecation and sunset of the version
+}
+
+var validMethods = map[string]bool{
+	"GET": true, "POST": true, "PUT": true, "PATCH": true,
+	"DELETE": true, "HEAD": true, "OPTIONS": true,
+}
+
+var validRoles = map[string]bool{
+	roleAdmin: true, roleManager: true, roleMember: true,
+}
+
+// loadConfig reads, expands and validates the gateway configuration file.
+func loadConfig(path string) (*GatewayConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg GatewayConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	cfg.CORS = cfg.CORS.withDefaults()
+	cfg.GraphQL = cfg.GraphQL.withDefaults()
+	cfg.Batch = cfg.Batch.withDefaults()
+	cfg.Idempotency = cfg.Idempotency.withDefaults()
+	if cfg.GraphQL.RateLimit == "" {
+		if _, ok := cfg.RateLimits[defaultRateLimit]; ok {
+			cfg.GraphQL.RateLimit = defaultRateLimit
+		}
+	}
+	if limit, ok := cfg.RateLimits[cfg.GraphQL.RateLimit]; ok {
+		cfg.GraphQL.limit = &limit
+	}
+	if cfg.Batch.RateLimit == "" {
+		if _, ok := cfg.RateLimits[defaultRateLimit]; ok {
+			cfg.Batch.RateLimit = defaultRateLimit
+		}
+	}
+	if limit, ok := cfg.RateLimits[cfg.Batch.RateLimit]; ok {
+		cfg.Batch.limit = &limit
+	}
+	for name, svc := range cfg.Services {
+		svc.Name = name
+		cfg.Services[name] = svc.withDefaults()
+	}
+	for i := range cfg.Routes {
+		route := &cfg.Routes[i]
+		route.Method = strings.ToUpper(route.Method)
+		if route.RateLimit == "" {
+			if _, ok := cfg.RateLimits[defaultRateLimit]; ok {
+				route.RateLimit = defaultRateLimit
+			}
+		}
+		if limit, ok := cfg.RateLimits[route.RateLimit]; ok {
+			route.limit = &limit
+		}
+		if t, ok := cfg.Transforms[route.Transform]; ok {
+			route.transform = &t
+		}
+		if route.Cache != nil && len(route.Cache.Tags) == 0 {
+			route.Cache.Tags = []string{route.Service}
+		}
+		if route.Stream && route.IdleTimeout == 0 {
+			route.IdleTimeout = defaultStreamIdleTimeout
+		}
+		if cfg.Idempotency.applies(*route) {
+			route.idempotency = &cfg.Idempotency
+		}
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("validate %s: %w", path, err)
+	}
+	cfg.endpoints = cfg.expandVersions()
+	return &cfg, nil
+}
+
+func (cfg *GatewayConfig) validate() error {
+	var errs []error
+
+	if len(cfg.Services) == 0 {
+		errs = append(errs, errors.New("no services defined"))
+	}
+	for name, svc := range cfg.Services {
+		if len(svc.URLs) == 0 {
+			errs = append(errs, fmt.Errorf("service %q: no instance urls", name))
+		}
+		for _, raw := range svc.URLs {
+			u, err := url.Parse(raw)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, fmt.Errorf("service %q: invalid url %q", name, raw))
+			}
+		}
+		if svc.Balancer != balancerRoundRobin && svc.Balancer != balancerLeastConnections {
+			errs = append(errs, fmt.Errorf("service %q: unknown balancer %q", name, svc.Balancer))
+		}
+		hc := svc.HealthCheck
+		if !strings.HasPrefix(hc.Path, "/") || hc.Interval <= 0 || hc.Timeout <= 0 ||
+			hc.HealthyThreshold < 1 || hc.UnhealthyThreshold < 1 {
+			errs = append(errs, fmt.Errorf("service %q: invalid health_check settings", name))
+		}
+		if svc.Timeouts.Dial < 0 || svc.Timeouts.Response < 0 {
+			errs = append(errs, fmt.Errorf("service %q: timeouts must be positive", name))
+		}
+		if svc.Retries.Attempts < 1 || svc.Retries.Backoff < 0 || svc.Retries.MaxBackoff < 0 {
+			errs = append(errs, fmt.Errorf("service %q: invalid retry settings", name))
+		}
+		if svc.Breaker.FailureThreshold < 1 || svc.Breaker.OpenTimeout < 0 {
+			errs = append(errs, fmt.Errorf("service %q: invalid breaker settings", name))
+		}
+	}
+
+	errs = append(errs, cfg.CORS.validate()...)
+	errs = append(errs, cfg.GraphQL.validate(cfg.Services)...)
+	errs = append(errs, cfg.Batch.validate()...)
+	errs = append(errs, cfg.Idempotency.validate()...)
+	errs = append(errs, cfg.validateVersions()...)
+
+	for name, limit := range cfg.RateLimits {
+		if limit.Requests <= 0 || limit.Per <= 0 || limit.Burst < 0 {
+			errs = append(errs, fmt.Errorf("rate limit %q: requests and per must be positive", name))
+		}
+	}
+	for name, t := range cfg.Transforms {
+		errs = append(errs, t.validate(name)...)
+	}
+
+	for _, route := range cfg.Routes {
+		if route.Auth {
+			if _, ok := cfg.Services[identityService]; !ok {
+				errs = append(errs, fmt.Errorf("authenticated routes need service %q to verify credentials", identityService))
+			}
+			break
+		}
+	}
+
+	seen := map[string]bool{}
+	for i, route := range cfg.Routes {
+		prefix := fmt.Sprintf("route %d (%s %s)", i, route.Method, route.Path)
+
+		if !validMethods[route.Method] {
+			errs = append(errs, fmt.Errorf("%s: invalid method", prefix))
+		}
+		if !strings.HasPrefix(route.Path, "/") {
+			errs = append(errs, fmt.Errorf("%s: path must start with /", prefix))
+		}
+		if _, ok := cfg.Services[route.Service]; !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown service %q", prefix, route.Service))
+		}
+		if len(route.Roles) > 0 && !route.Auth {
+			errs = append(errs, fmt.Errorf("%s: roles require auth: true", prefix))
+		}
+		for _, role := range route.Roles {
+			if !validRoles[role] {
+				errs = append(errs, fmt.Errorf("%s: unknown role %q", prefix, role))
+			}
+		}
+		if len(route.Scopes) > 0 && !route.Auth {
+			errs = append(errs, fmt.Errorf("%s: scopes require auth: true", prefix))
+		}
+		if route.RequireVerified && !route.Auth {
+			errs = append(errs, fmt.Errorf("%s: require_verified requires auth: true", prefix))
+		}
+		if route.OwnerParam != "" {
+			if !route.Auth {
+				errs = append(errs, fmt.Errorf("%s: owner_param requires auth: true", prefix))
+			}
+			if !slices.Contains(strings.Split(route.Path, "/"), ":"+route.OwnerParam) {
+				errs = append(errs, fmt.Errorf("%s: owner_param %q is not a path parameter", prefix, route.OwnerParam))
+			}
+		}
+		if route.QueryToken && !route.Auth {
+			errs = append(errs, fmt.Errorf("%s: query_token requires auth: true", prefix))
+		}
+		for _, scope := range route.Scopes {
+			if !validScopes[scope] {
+				errs = append(errs, fmt.Errorf("%s: unknown scope %q", prefix, scope))
+			}
+		}
+		if route.RateLimit != "" && route.limit == nil {
+			errs = append(errs, fmt.Errorf("%s: unknown rate limit %q", prefix, route.RateLimit))
+		}
+		if route.Transform != "" && route.transform == nil {
+			errs = append(errs, fmt.Errorf("%s: unknown transform %q", prefix, route.Transform))
+		}
+		if route.Stream && route.transform != nil && !route.transform.ResponseBody.empty() {
+			errs = append(errs, fmt.Errorf("%s: stream routes cannot transform response bodies", prefix))
+		}
+		if route.Cache != nil {
+			if route.Method != http.MethodGet || !route.Auth || route.Stream {
+				errs = append(errs, fmt.Errorf("%s: cache requires an authenticated GET route", prefix))
+			}
+			if err := route.Cache.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", prefix, err))
+			}
+		}
+		if route.IdleTimeout != 0 && !route.Stream {
+			errs = append(errs, fmt.Errorf("%s: idle_timeout requires stream: true", prefix))
+		}
+		if route.IdleTimeout < 0 {
+			errs = append(errs, fmt.Errorf("%s: idle_timeout must be positive", prefix))
+		}
+		if route.Rewrite != "" {
+			if err := validateRewrite(route.Path, route.Rewrite); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", prefix, err))
+			}
+		}
+
+		key := cfg.versionOf(route) + " " + route.Method + " " + route.Path
+		if seen[key] {
+			errs = append(errs, fmt.Errorf("%s: duplicate route", prefix))
+		}
+		seen[key] = true
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateRewrite ensures every parameter used in the rewrite template is
+// captured by the route path.
+func validateRewrite(path, rewrite string) error {
+	if !strings.HasPrefix(rewrite, "/") {
+		return errors.New("rewrite must start with /")
+	}
+
+	params := map[string]bool{}
+	for _, seg := range strings.Split(path, "/") {
+		if strings.HasPrefix(seg, ":") || strings.HasPrefix(seg, "*") {
+			params[seg[1:]] = true
+		}
+	}
+	for _, seg := range strings.Split(rewrite, "/") {
+		if (strings.HasPrefix(seg, ":") || strings.HasPrefix(seg, "*")) && !params[seg[1:]] {
+			return fmt.Errorf("rewrite references unknown parameter %q", seg)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CORSConfig is the cross-origin policy for browser clients. Requests from
+// origins not on the allow-list are rejected with 403; same-origin requests
+// and clients that send no Origin header are unaffected.
+type CORSConfig struct {
+	// AllowedOrigins lists scheme://host[:port] origins. A leading "*." in
+	// the host matches any subdomain; a lone "*" matches every origin.
+	AllowedOrigins   []string      `yaml:"allowed_origins"`
+	AllowedMethods   []string      `yaml:"allowed_methods"`
+	AllowedHeaders   []string      `yaml:"allowed_headers"`
+	ExposedHeaders   []string      `yaml:"exposed_headers"`
+	AllowCredentials bool          `yaml:"allow_credentials"`
+	MaxAge           time.Duration `yaml:"max_age"`
+}
+
+func (c CORSConfig) withDefaults() CORSConfig {
+	if len(c.AllowedMethods) == 0 {
+		c.AllowedMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+	}
+	if len(c.AllowedHeaders) == 0 {
+		c.AllowedHeaders = []string{"Content-Type", "Authorization", headerAPIKey, headerRequestID, headerIdempotencyKey}
+	}
+	for i, m := range c.AllowedMethods {
+		c.AllowedMethods[i] = strings.ToUpper(m)
+	}
+	return c
+}
+
+func (c CORSConfig) validate() []error {
+	var errs []error
+	for _, origin := range c.AllowedOrigins {
+		if origin == "*" {
+			if c.AllowCredentials {
+				errs = append(errs, errors.New(`cors: "*" cannot be combined with allow_credentials`))
+			}
+			continue
+		}
+		u, err := url.Parse(strings.Replace(origin, "://*.", "://", 1))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			(u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			errs = append(errs, fmt.Errorf("cors: invalid origin %q", origin))
+		}
+	}
+	for _, m := range c.AllowedMethods {
+		if !validMethods[m] {
+			errs = append(errs, fmt.Errorf("cors: invalid method %q", m))
+		}
+	}
+	if c.MaxAge < 0 {
+		errs = append(errs, errors.New("cors: max_age must not be negative"))
+	}
+	return errs
+}
+
+// allowsOrigin reports whether origin matches the allow-list.
+func (c CORSConfig) allowsOrigin(origin string) bool {
+	origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+	for _, allowed := range c.AllowedOrigins {
+		allowed = strings.ToLower(strings.TrimSuffix(allowed, "/"))
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		// https://*.example.com matches https://app.example.com
+		if scheme, domain, ok := strings.Cut(allowed, "://*."); ok &&
+			strings.HasPrefix(origin, scheme+"://") && strings.HasSuffix(origin, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// cors enforces the CORS policy and answers preflight requests. It runs for
+// every request, including unmatched ones, so preflights never reach a route.
+func cors(cfg CORSConfig) gin.HandlerFunc {
+	methods := map[string]bool{}
+	for _, m := range cfg.AllowedMethods {
+		methods[m] = true
+	}
+	headers := map[string]bool{}
+	for _, h := range cfg.AllowedHeaders {
+		headers[http.CanonicalHeaderKey(h)] = true
+	}
+	allowMethods := strings.Join(cfg.AllowedMethods, ", ")
+	allowHeaders := strings.Join(cfg.AllowedHeaders, ", ")
+	exposeHeaders := strings.Join(cfg.ExposedHeaders, ", ")
+	maxAge := strconv.Itoa(int(cfg.MaxAge.Seconds()))
+
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" || sameOrigin(origin, c.Request.Host) {
+			c.Next()
+			return
+		}
+
+		h := c.Writer.Header()
+		h.Add("Vary", "Origin")
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+
+		if !cfg.allowsOrigin(origin) {
+			slog.Warn("cors origin rejected",
+				"request_id", c.GetString(ctxRequestID),
+				"origin", origin,
+				"path", c.Request.URL.Path)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Origin not allowed"})
+			return
+		}
+
+		h.Set("Access-Control-Allow-Origin", origin)
+		if cfg.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			if exposeHeaders != "" {
+				h.Set("Access-Control-Expose-Headers", exposeHeaders)
+			}
+			c.Next()
+			return
+		}
+
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		if !methods[strings.ToUpper(c.GetHeader("Access-Control-Request-Method"))] {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Method not allowed by CORS policy"})
+			return
+		}
+		for _, name := range strings.Split(c.GetHeader("Access-Control-Request-Headers"), ",") {
+			if name = strings.TrimSpace(name); name != "" && !headers[http.CanonicalHeaderKey(name)] {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Header not allowed by CORS policy: " + name})
+				return
+			}
+		}
+
+		h.Set("Access-Control-Allow-Methods", allowMethods)
+		h.Set("Access-Control-Allow-Headers", allowHeaders)
+		if cfg.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", maxAge)
+		}
+		c.AbortWithStatus(http.StatusNoContent)
+	}
+}
+
+// sameOrigin reports whether origin names the host the request was sent to,
+// as for pages served through the gateway itself. The scheme is not compared
+// since TLS may be terminated in front of the gateway.
+func sameOrigin(origin, host string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, host)
+}
@@ -0,0 +1,616 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-go/graphql"
+)
+
+// Upstreams queried by the GraphQL resolvers
+const (
+	tasksService         = "tasks"
+	assignmentsService   = "assignments"
+	notificationsService = "notifications"
+)
+
+// graphqlBatchSize matches the ID limit of the services' batch lookups.
+const graphqlBatchSize = 100
+
+const graphqlMaxBodyBytes = 1 << 20
+
+// GraphQLConfig enables the read-only /graphql endpoint. Resolvers call the
+// same service endpoints as the REST routes, batching lookups by ID.
+type GraphQLConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// RateLimit names an entry in rate_limits (defaults to "default" when
+	// defined). Each query takes one token.
+	RateLimit string `yaml:"rate_limit"`
+	// MaxUpstreamCalls bounds the service requests a single query may make.
+	MaxUpstreamCalls int `yaml:"max_upstream_calls"`
+
+	limit *RateLimit
+}
+
+func (c GraphQLConfig) withDefaults() GraphQLConfig {
+	if c.MaxUpstreamCalls == 0 {
+		c.MaxUpstreamCalls = 25
+	}
+	return c
+}
+
+func (c GraphQLConfig) validate(services map[string]ServiceConfig) []error {
+	if !c.Enabled {
+		return nil
+	}
+	var errs []error
+	for _, name := range []string{identityService, tasksService, assignmentsService, notificationsService} {
+		if _, ok := services[name]; !ok {
+			errs = append(errs, fmt.Errorf("graphql: needs service %q", name))
+		}
+	}
+	if c.RateLimit != "" && c.limit == nil {
+		errs = append(errs, fmt.Errorf("graphql: unknown rate limit %q", c.RateLimit))
+	}
+	if c.MaxUpstreamCalls < 1 {
+		errs = append(errs, errors.New("graphql: max_upstream_calls must be positive"))
+	}
+	return errs
+}
+
+type graphqlUser struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Role     string `json:"role"`
+}
+
+type graphqlTask struct {
+	ID          int       `json:"id"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Status      string    `json:"status"`
+	CreatedBy   int       `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type graphqlAssignment struct {
+	ID         int       `json:"id"`
+	TaskID     int       `json:"task_id"`
+	AssignedTo int       `json:"assigned_to"`
+	AssignedBy int       `json:"assigned_by"`
+	AssignedAt time.Time `json:"assigned_at"`
+	Status     string    `json:"status"`
+}
+
+type graphqlNotification struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Message   string    `json:"message"`
+	Type      string    `json:"type"`
+	IsRead    bool      `json:"is_read"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// serveGraphQL executes a query on behalf of the authenticated caller. API
+// keys need the read scope of every service the query touches.
+func (g *APIGateway) serveGraphQL(cfg GraphQLConfig, services map[string]*upstream) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, h := range identityHeaders {
+			c.Request.Header.Del(h)
+		}
+		if cfg.limit != nil && !g.rateLimitIP(c, cfg.RateLimit, *cfg.limit) {
+			return
+		}
+		if !g.authenticateRequest(c) {
+			return
+		}
+		c.Request.Header.Del(headerAPIKey)
+		if cfg.limit != nil && !g.rateLimitUser(c, cfg.RateLimit, *cfg.limit) {
+			return
+		}
+
+		var req struct {
+			Query         string         `json:"query" binding:"required"`
+			OperationName string         `json:"operationName"`
+			Variables     map[string]any `json:"variables"`
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, graphqlMaxBodyBytes)
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		schema, err := graphqlSchema()
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "GraphQL schema unavailable"})
+			return
+		}
+
+		rc := newGraphQLResolver(c, services, cfg.MaxUpstreamCalls)
+		result := graphql.Do(graphql.Params{
+			Schema:         schema,
+			RequestString:  req.Query,
+			VariableValues: req.Variables,
+			OperationName:  req.OperationName,
+			Context:        context.WithValue(c.Request.Context(), graphqlResolverKey{}, rc),
+		})
+		if result.HasErrors() {
+			slog.Warn("graphql query failed",
+				"request_id", c.GetString(ctxRequestID),
+				"user_id", c.GetInt64(ctxUserID),
+				"errors", len(result.Errors),
+				"error", result.Errors[0].Message)
+		}
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+type graphqlResolverKey struct{}
+
+// graphqlResolver holds the per-request state of a query: the caller's
+// identity forwarded to the services and one batch loader per lookup.
+type graphqlResolver struct {
+	services map[string]*upstream
+	header   http.Header
+	scopes   []string // nil for JWT callers
+	calls    atomic.Int32
+	maxCalls int32
+
+	users         *batchLoader[int, *graphqlUser]
+	tasks         *batchLoader[int, *graphqlTask]
+	assignments   *batchLoader[int, []*graphqlAssignment]   // by task ID
+	notifications *batchLoader[int, []*graphqlNotification] // by user ID
+}
+
+func newGraphQLResolver(c *gin.Context, services map[string]*upstream, maxCalls int) *graphqlResolver {
+	rc := &graphqlResolver{
+		services: services,
+		header:   http.Header{},
+		maxCalls: int32(maxCalls),
+	}
+	for _, h := range append(identityHeaders, headerRequestID) {
+		if v := c.Request.Header.Get(h); v != "" {
+			rc.header.Set(h, v)
+		}
+	}
+	if granted, ok := c.Get(ctxScopes); ok {
+		rc.scopes = granted.([]string)
+	}
+
+	rc.users = newBatchLoader(rc.fetchUsers)
+	rc.tasks = newBatchLoader(rc.fetchTasks)
+	rc.assignments = newBatchLoader(rc.fetchAssignments)
+	rc.notifications = newBatchLoader(rc.fetchNotifications)
+	return rc
+}
+
+func resolverFrom(p graphql.ResolveParams) *graphqlResolver {
+	return p.Context.Value(graphqlResolverKey{}).(*graphqlResolver)
+}
+
+// require fails unless an API key caller holds scope.
+func (rc *graphqlResolver) require(scope string) error {
+	if rc.scopes != nil && !hasScopes(rc.scopes, []string{scope}) {
+		return fmt.Errorf("insufficient scope: %s required", scope)
+	}
+	return nil
+}
+
+// get fetches path from service as the caller and decodes the JSON response.
+func (rc *graphqlResolver) get(ctx context.Context, service, path string, out any) error {
+	if rc.calls.Add(1) > rc.maxCalls {
+		return fmt.Errorf("query needs more than %d upstream requests", rc.maxCalls)
+	}
+	u := rc.services[service]
+	if u == nil {
+		return fmt.Errorf("service %q is not configured", service)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+u.name+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header = rc.header.Clone()
+	resp, err := u.RoundTrip(req)
+	if err != nil {
+		return fmt.Errorf("%s unavailable", service)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", service, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(out)
+}
+
+func (rc *graphqlResolver) fetchUsers(ctx context.Context, ids []int) (map[int]*graphqlUser, error) {
+	users := map[int]*graphqlUser{}
+	for _, chunk := range chunkIDs(ids) {
+		var page []*graphqlUser
+		if err := rc.get(ctx, identityService, "/api/users?ids="+chunk, &page); err != nil {
+			return nil, err
+		}
+		for _, u := range page {
+			users[u.ID] = u
+		}
+	}
+	return users, nil
+}
+
+func (rc *graphqlResolver) fetchTasks(ctx context.Context, ids []int) (map[int]*graphqlTask, error) {
+	tasks := map[int]*graphqlTask{}
+	for _, chunk := range chunkIDs(ids) {
+		var page []*graphqlTask
+		if err := rc.get(ctx, tasksService, "/api/tasks?ids="+chunk, &page); err != nil {
+			return nil, err
+		}
+		for _, t := range page {
+			tasks[t.ID] = t
+		}
+	}
+	return tasks, nil
+}
+
+func (rc *graphqlResolver) fetchAssignments(ctx context.Context, taskIDs []int) (map[int][]*graphqlAssignment, error) {
+	byTask := make(map[int][]*graphqlAssignment, len(taskIDs))
+	for _, id := range taskIDs {
+		byTask[id] = []*graphqlAssignment{}
+	}
+	for _, chunk := range chunkIDs(taskIDs) {
+		var page []*graphqlAssignment
+		if err := rc.get(ctx, assignmentsService, "/api/assignments?task_ids="+chunk, &page); err != nil {
+			return nil, err
+		}
+		for _, a := range page {
+			byTask[a.TaskID] = append(byTask[a.TaskID], a)
+		}
+	}
+	return byTask, nil
+}
+
+// fetchNotifications has no batch endpoint to call, so it makes one request
+// per user.
+func (rc *graphqlResolver) fetchNotifications(ctx context.Context, userIDs []int) (map[int][]*graphqlNotification, error) {
+	byUser := make(map[int][]*graphqlNotification, len(userIDs))
+	for _, id := range userIDs {
+		list := []*graphqlNotification{}
+		if err := rc.get(ctx, notificationsService, "/api/notifications/user/"+strconv.Itoa(id), &list); err != nil {
+			return nil, err
+		}
+		if list == nil {
+			list = []*graphqlNotification{}
+		}
+		byUser[id] = list
+	}
+	return byUser, nil
+}
+
+// chunkIDs splits ids into comma-separated lists of at most
+// graphqlBatchSize.
+func chunkIDs(ids []int) []string {
+	var chunks []string
+	for start := 0; start < len(ids); start += graphqlBatchSize {
+		end := min(start+graphqlBatchSize, len(ids))
+		parts := make([]string, 0, end-start)
+		for _, id := range ids[start:end] {
+			parts = append(parts, strconv.Itoa(id))
+		}
+		chunks = append(chunks, strings.Join(parts, ","))
+	}
+	return chunks
+}
+
+// batchLoader collects the keys requested while a level of the query is
+// resolved and fetches them in one call when the first result is needed.
+// Results are cached for the rest of the request.
+type batchLoader[K comparable, V any] struct {
+	fetch func(ctx context.Context, keys []K) (map[K]V, error)
+
+	mu      sync.Mutex
+	pending []K
+	queued  map[K]bool
+	results map[K]loadResult[V]
+}
+
+type loadResult[V any] struct {
+	value V
+	err   error
+}
+
+func newBatchLoader[K comparable, V any](fetch func(context.Context, []K) (map[K]V, error)) *batchLoader[K, V] {
+	return &batchLoader[K, V]{
+		fetch:   fetch,
+		queued:  map[K]bool{},
+		results: map[K]loadResult[V]{},
+	}
+}
+
+// load queues key and returns a thunk for graphql-go, which runs thunks only
+// after every sibling field has been resolved.
+func (l *batchLoader[K, V]) load(ctx context.Context, key K) func() (interface{}, error) {
+	l.mu.Lock()
+	if _, done := l.results[key]; !done && !l.queued[key] {
+		l.queued[key] = true
+		l.pending = append(l.pending, key)
+	}
+	l.mu.Unlock()
+
+	return func() (interface{}, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		if len(l.pending) > 0 {
+			keys := l.pending
+			l.pending = nil
+			values, err := l.fetch(ctx, keys)
+			for _, k := range keys {
+				l.results[k] = loadResult[V]{value: values[k], err: err}
+				delete(l.queued, k)
+			}
+		}
+		r := l.results[key]
+		return r.value, r.err
+	}
+}
+
+// prime caches a value fetched by other means.
+func (l *batchLoader[K, V]) prime(key K, value V) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.results[key]; !ok && !l.queued[key] {
+		l.results[key] = loadResult[V]{value: value}
+	}
+}
+
+func (rc *graphqlResolver) user(ctx context.Context, id int) (interface{}, error) {
+	if err := rc.require("users:read"); err != nil {
+		return nil, err
+	}
+	return rc.users.load(ctx, id), nil
+}
+
+func (rc *graphqlResolver) task(ctx context.Context, id int) (interface{}, error) {
+	if err := rc.require("tasks:read"); err != nil {
+		return nil, err
+	}
+	return rc.tasks.load(ctx, id), nil
+}
+
+// graphqlSchema builds the schema once.
+var graphqlSchema = sync.OnceValues(func() (graphql.Schema, error) {
+	notificationType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Notification",
+		Fields: graphql.Fields{
+			"id":        field(graphql.ID, func(n *graphqlNotification) any { return n.ID }),
+			"message":   field(graphql.String, func(n *graphqlNotification) any { return n.Message }),
+			"type":      field(graphql.String, func(n *graphqlNotification) any { return n.Type }),
+			"isRead":    field(graphql.Boolean, func(n *graphqlNotification) any { return n.IsRead }),
+			"createdAt": field(graphql.DateTime, func(n *graphqlNotification) any { return n.CreatedAt }),
+		},
+	})
+
+	userType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"id":       field(graphql.ID, func(u *graphqlUser) any { return u.ID }),
+			"username": field(graphql.String, func(u *graphqlUser) any { return u.Username }),
+			"email":    field(graphql.String, func(u *graphqlUser) any { return u.Email }),
+			"role":     field(graphql.String, func(u *graphqlUser) any { return u.Role }),
+			"notifications": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(notificationType))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					rc := resolverFrom(p)
+					if err := rc.require("notifications:read"); err != nil {
+						return nil, err
+					}
+					return rc.notifications.load(p.Context, p.Source.(*graphqlUser).ID), nil
+				},
+			},
+		},
+	})
+
+	// Task and Assignment refer to each other, so their fields are thunks
+	var taskType *graphql.Object
+	assignmentType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Assignment",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"id":         field(graphql.ID, func(a *graphqlAssignment) any { return a.ID }),
+				"status":     field(graphql.String, func(a *graphqlAssignment) any { return a.Status }),
+				"assignedAt": field(graphql.DateTime, func(a *graphqlAssignment) any { return a.AssignedAt }),
+				"task": &graphql.Field{
+					Type: taskType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return resolverFrom(p).task(p.Context, p.Source.(*graphqlAssignment).TaskID)
+					},
+				},
+				"assignee": &graphql.Field{
+					Type: userType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return resolverFrom(p).user(p.Context, p.Source.(*graphqlAssignment).AssignedTo)
+					},
+				},
+				"assignedBy": &graphql.Field{
+					Type: userType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return resolverFrom(p).user(p.Context, p.Source.(*graphqlAssignment).AssignedBy)
+					},
+				},
+			}
+		}),
+	})
+
+	taskType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Task",
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"id":          field(graphql.ID, func(t *graphqlTask) any { return t.ID }),
+				"title":       field(graphql.String, func(t *graphqlTask) any { return t.Title }),
+				"description": field(graphql.String, func(t *graphqlTask) any { return t.Description }),
+				"status":      field(graphql.String, func(t *graphqlTask) any { return t.Status }),
+				"createdAt":   field(graphql.DateTime, func(t *graphqlTask) any { return t.CreatedAt }),
+				"createdBy": &graphql.Field{
+					Type: userType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return resolverFrom(p).user(p.Context, p.Source.(*graphqlTask).CreatedBy)
+					},
+				},
+				"assignments": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(assignmentType))),
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						rc := resolverFrom(p)
+						if err := rc.require("assignments:read"); err != nil {
+							return nil, err
+						}
+						return rc.assignments.load(p.Context, p.Source.(*graphqlTask).ID), nil
+					},
+				},
+			}
+		}),
+	})
+
+	idArg := graphql.FieldConfigArgument{
+		"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+	}
+
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"me": &graphql.Field{
+				Type:        userType,
+				Description: "The authenticated caller",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					rc := resolverFrom(p)
+					id, _ := strconv.Atoi(rc.header.Get(headerUserID))
+					return rc.user(p.Context, id)
+				},
+			},
+			"user": &graphql.Field{
+				Type: userType,
+				Args: idArg,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id, err := idArgument(p.Args["id"])
+					if err != nil {
+						return nil, err
+					}
+					return resolverFrom(p).user(p.Context, id)
+				},
+			},
+			"users": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(userType)),
+				Args: graphql.FieldConfigArgument{
+					"ids": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.ID)))},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					rc := resolverFrom(p)
+					var users []interface{}
+					for _, raw := range p.Args["ids"].([]interface{}) {
+						id, err := idArgument(raw)
+						if err != nil {
+							return nil, err
+						}
+						u, err := rc.user(p.Context, id)
+						if err != nil {
+							return nil, err
+						}
+						users = append(users, u)
+					}
+					return users, nil
+				},
+			},
+			"task": &graphql.Field{
+				Type: taskType,
+				Args: idArg,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id, err := idArgument(p.Args["id"])
+					if err != nil {
+						return nil, err
+					}
+					return resolverFrom(p).task(p.Context, id)
+				},
+			},
+			"tasks": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(taskType))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					rc := resolverFrom(p)
+					if err := rc.require("tasks:read"); err != nil {
+						return nil, err
+					}
+					var tasks []*graphqlTask
+					if err := rc.get(p.Context, tasksService, "/api/tasks", &tasks); err != nil {
+						return nil, err
+					}
+					for _, t := range tasks {
+						rc.tasks.prime(t.ID, t)
+					}
+					return tasks, nil
+				},
+			},
+			"assignments": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(assignmentType))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					rc := resolverFrom(p)
+					if err := rc.require("assignments:read"); err != nil {
+						return nil, err
+					}
+					var assignments []*graphqlAssignment
+					if err := rc.get(p.Context, assignmentsService, "/api/assignments", &assignments); err != nil {
+						return nil, err
+					}
+					return assignments, nil
+				},
+			},
+			"notifications": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(notificationType))),
+				Args: graphql.FieldConfigArgument{
+					"userId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					rc := resolverFrom(p)
+					if err := rc.require("notifications:read"); err != nil {
+						return nil, err
+					}
+					id, err := idArgument(p.Args["userId"])
+					if err != nil {
+						return nil, err
+					}
+					return rc.notifications.load(p.Context, id), nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: queryType})
+})
+
+// field resolves a non-null scalar from the source object.
+func field[T any](typ graphql.Output, get func(T) any) *graphql.Field {
+	return &graphql.Field{
+		Type: graphql.NewNonNull(typ),
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return get(p.Source.(T)), nil
+		},
+	}
+}
+
+func idArgument(raw interface{}) (int, error) {
+	s, _ := raw.(string)
+	id, err := strconv.Atoi(s)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid id %q", s)
+	}
+	return id, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Load balancing strategies
+const (
+	balancerRoundRobin       = "round_robin"
+	balancerLeastConnections = "least_connections"
+)
+
+// startHealthChecks probes every instance until stopHealthChecks is called.
+// Instances leave rotation after UnhealthyThreshold consecutive failed
+// probes and return after HealthyThreshold consecutive successes.
+func (u *upstream) startHealthChecks() {
+	if u.health.Disabled {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	u.stop = cancel
+
+	client := &http.Client{Timeout: u.health.Timeout}
+	for _, b := range u.backends {
+		go u.probeLoop(ctx, client, b)
+	}
+}
+
+func (u *upstream) stopHealthChecks() {
+	u.stop()
+}
+
+func (u *upstream) probeLoop(ctx context.Context, client *http.Client, b *backend) {
+	ticker := time.NewTicker(u.health.Interval)
+	defer ticker.Stop()
+
+	for {
+		u.probe(ctx, client, b)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (u *upstream) probe(ctx context.Context, client *http.Client, b *backend) {
+	ok := false
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.url.JoinPath(u.health.Path).String(), nil)
+	if err == nil {
+		err = u.signer.sign(req)
+	}
+	if err == nil {
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			ok = resp.StatusCode >= 200 && resp.StatusCode < 300
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	if ok {
+		b.fails = 0
+		b.passes++
+		if !b.healthy.Load() && b.passes >= u.health.HealthyThreshold {
+			b.healthy.Store(true)
+			log.Printf("Backend %s for %s is healthy, returning to rotation", b.url, u.name)
+		}
+		return
+	}
+
+	b.passes = 0
+	b.fails++
+	if b.healthy.Load() && b.fails >= u.health.UnhealthyThreshold {
+		b.healthy.Store(false)
+		log.Printf("Backend %s for %s failed %d health checks, removing from rotation", b.url, u.name, b.fails)
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	headerIdempotencyKey = "Idempotency-Key"
+	headerReplayed       = "Idempotent-Replayed"
+)
+
+const maxIdempotencyKeyLength = 255
+
+// maxIdempotentBody is the largest request or response body an idempotent
+// request may have; larger responses are passed through without storing.
+const maxIdempotentBody = 1 << 20
+
+// Response headers kept with a stored response. Per-request headers such as
+// X-Request-ID and rate limit state are written fresh on replay.
+var idempotentHeaders = []string{"Content-Type", "Content-Location", "Location", "ETag", "Last-Modified"}
+
+// IdempotencyConfig makes an Idempotency-Key header on authenticated POST,
+// PUT, PATCH and DELETE routes return the first response for a key on
+// retries instead of repeating the request.
+type IdempotencyConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// TTL is how long a response is kept for replay.
+	TTL time.Duration `yaml:"ttl"`
+	// LockTimeout bounds how long a request in progress holds its key, and
+	// how long retries are refused when the service did not answer or the
+	// gateway died before storing the response.
+	LockTimeout time.Duration `yaml:"lock_timeout"`
+}
+
+func (c IdempotencyConfig) withDefaults() IdempotencyConfig {
+	if c.TTL == 0 {
+		c.TTL = 24 * time.Hour
+	}
+	if c.LockTimeout == 0 {
+		c.LockTimeout = time.Minute
+	}
+	return c
+}
+
+func (c IdempotencyConfig) validate() []error {
+	if c.TTL < 0 || c.LockTimeout < 0 {
+		return []error{errors.New("idempotency: ttl and lock_timeout must be positive")}
+	}
+	return nil
+}
+
+// applies reports whether a route takes idempotency keys.
+func (c IdempotencyConfig) applies(route RouteConfig) bool {
+	if !c.Enabled || !route.Auth || route.Stream {
+		return false
+	}
+	switch route.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// idempotencyRecord is the state stored under a key: the request it was first
+// used with and, once complete, the response.
+type idempotencyRecord struct {
+	Fingerprint string      `json:"fingerprint"`
+	Done        bool        `json:"done"`
+	Status      int         `json:"status,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+}
+
+// IdempotencyStore keeps idempotency records.
+type IdempotencyStore interface {
+	// Begin claims key for a request with fingerprint. It returns nil if the
+	// key was free, and the existing record otherwise.
+	Begin(ctx context.Context, key, fingerprint string, lock time.Duration) (*idempotencyRecord, error)
+	// Complete stores the response for a claimed key.
+	Complete(ctx context.Context, key string, record idempotencyRecord, ttl time.Duration) error
+	// Release frees a claimed key so the request can be retried.
+	Release(ctx context.Context, key string) error
+	// Close releases background work and connections.
+	Close() error
+}
+
+// newIdempotencyStore returns a Redis-backed store when REDIS_URL is set so
+// that a retry reaching another replica is still recognized, and an
+// in-memory store otherwise.
+func newIdempotencyStore(redisURL string) (IdempotencyStore, error) {
+	if redisURL == "" {
+		return newMemoryIdempotencyStore(), nil
+	}
+
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse REDIS_URL: %w", err)
+	}
+	return &redisIdempotencyStore{client: redis.NewClient(opts)}, nil
+}
+
+// idempotent handles the Idempotency-Key header of a request. It returns
+// false when the response has been written, either replayed or as an error.
+// Otherwise the request proceeds and finish must be called once it has been
+// proxied. It must run after authenticateRequest.
+func (g *APIGateway) idempotent(c *gin.Context, cfg IdempotencyConfig) (finish func(), ok bool) {
+	idemKey := c.GetHeader(headerIdempotencyKey)
+	if idemKey == "" {
+		return func() {}, true
+	}
+	if len(idemKey) > maxIdempotencyKeyLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key is too long"})
+		return nil, false
+	}
+	userID, ok := c.Get(ctxUserID)
+	if !ok {
+		return func() {}, true
+	}
+	key := fmt.Sprintf("idempotency:user:%d:%s", userID, idemKey)
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxIdempotentBody+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+		return nil, false
+	}
+	if len(body) > maxIdempotentBody {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body too large for an idempotent request"})
+		return nil, false
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	c.Request.ContentLength = int64(len(body))
+
+	sum := sha256.New()
+	fmt.Fprintf(sum, "%s %s\n", c.Request.Method, c.Request.URL.RequestURI())
+	sum.Write(body)
+	fingerprint := hex.EncodeToString(sum.Sum(nil))
+
+	ctx := c.Request.Context()
+	record, err := g.idempotency.Begin(ctx, key, fingerprint, cfg.LockTimeout)
+	if err != nil {
+		// Fail open like the rate limiter; the request runs unprotected
+		log.Printf("Idempotency store error for %s: %v", key, err)
+		return func() {}, true
+	}
+
+	switch {
+	case record == nil:
+	case record.Fingerprint != fingerprint:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used with a different request"})
+		return nil, false
+	case !record.Done:
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still in progress"})
+		return nil, false
+	default:
+		h := c.Writer.Header()
+		for name, values := range record.Header {
+			h[name] = values
+		}
+		h.Set(headerReplayed, "true")
+		c.Data(record.Status, record.Header.Get("Content-Type"), record.Body)
+		return nil, false
+	}
+
+	// Once sent, the request runs to completion even if the client goes
+	// away, so its retry can be answered with the response
+	attempt := &proxyAttempt{}
+	proxyCtx, cancel := context.WithCancel(context.WithValue(context.WithoutCancel(ctx), proxyAttemptKey{}, attempt))
+	c.Request = c.Request.WithContext(proxyCtx)
+	w := &recordingWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+	return func() {
+		cancel()
+		c.Writer = w.ResponseWriter
+
+		switch {
+		case attempt.notSent:
+			// Rejected before reaching the service, so a retry is safe
+			if err := g.idempotency.Release(context.WithoutCancel(ctx), key); err != nil {
+				log.Printf("Idempotency store error for %s: %v", key, err)
+			}
+			return
+		case attempt.failed || w.overflow:
+			// The service may have acted on the request without a response
+			// to replay; the key stays pending until LockTimeout
+			return
+		}
+
+		stored := idempotencyRecord{Fingerprint: fingerprint, Done: true, Status: w.Status(), Header: http.Header{}, Body: w.body.Bytes()}
+		for _, name := range idempotentHeaders {
+			if v := w.Header().Values(name); len(v) > 0 {
+				stored.Header[name] = v
+			}
+		}
+		if err := g.idempotency.Complete(context.WithoutCancel(ctx), key, stored, cfg.TTL); err != nil {
+			log.Printf("Idempotency store error for %s: %v", key, err)
+		}
+	}, true
+}
+
+type proxyAttemptKey struct{}
+
+// proxyAttempt tells finish how the proxy of an idempotent request ended.
+type proxyAttempt struct {
+	failed  bool // no response from the service
+	notSent bool // and the request never reached it
+}
+
+// markProxyFailure records on an idempotent request that the proxy gave up
+// with err.
+func markProxyFailure(r *http.Request, err error) {
+	attempt, ok := r.Context().Value(proxyAttemptKey{}).(*proxyAttempt)
+	if !ok {
+		return
+	}
+	attempt.failed = true
+	attempt.notSent = errors.Is(err, errCircuitOpen) || errors.Is(err, errNoHealthyBackend)
+}
+
+// recordingWriter keeps a copy of the response body. Write errors are not
+// passed on, so the whole response is read and stored even if the client
+// has gone away.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.record(p)
+	w.ResponseWriter.Write(p)
+	return len(p), nil
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.record([]byte(s))
+	w.ResponseWriter.WriteString(s)
+	return len(s), nil
+}
+
+func (w *recordingWriter) record(p []byte) {
+	if w.overflow || w.body.Len()+len(p) > maxIdempotentBody {
+		w.overflow = true
+		return
+	}
+	w.body.Write(p)
+}
+
+type idempotencyEntry struct {
+	record  idempotencyRecord
+	expires time.Time
+}
+
+type memoryIdempotencyStore struct {
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+	done    chan struct{}
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	s := &memoryIdempotencyStore{entries: map[string]*idempotencyEntry{}, done: make(chan struct{})}
+	go s.cleanup(time.Minute)
+	return s
+}
+
+func (s *memoryIdempotencyStore) Close() error {
+	close(s.done)
+	return nil
+}
+
+func (s *memoryIdempotencyStore) Begin(ctx context.Context, key, fingerprint string, lock time.Duration) (*idempotencyRecord, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.entries[key]; ok && now.Before(e.expires) {
+		record := e.record
+		return &record, nil
+	}
+	s.entries[key] = &idempotencyEntry{
+		record:  idempotencyRecord{Fingerprint: fingerprint},
+		expires: now.Add(lock),
+	}
+	return nil, nil
+}
+
+func (s *memoryIdempotencyStore) Complete(ctx context.Context, key string, record idempotencyRecord, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[key] = &idempotencyEntry{record: record, expires: time.Now().Add(ttl)}
+	return nil
+}
+
+func (s *memoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+// cleanup drops expired records.
+func (s *memoryIdempotencyStore) cleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+
+		s.mu.Lock()
+		for key, e := range s.entries {
+			if now.After(e.expires) {
+				delete(s.entries, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// redisIdempotencyStore keeps each record as JSON under its key. A claim is
+// a SET NX of the pending record, so only one replica proceeds.
+type redisIdempotencyStore struct {
+	client *redis.Client
+}
+
+func (s *redisIdempotencyStore) Close() error {
+	return s.client.Close()
+}
+
+func (s *redisIdempotencyStore) Begin(ctx context.Context, key, fingerprint string, lock time.Duration) (*idempotencyRecord, error) {
+	pending, err := json.Marshal(idempotencyRecord{Fingerprint: fingerprint})
+	if err != nil {
+		return nil, err
+	}
+
+	// The existing record may expire between SET NX and GET; try again then
+	for range 3 {
+		claimed, err := s.client.SetNX(ctx, key, pending, lock).Result()
+		if err != nil {
+			return nil, err
+		}
+		if claimed {
+			return nil, nil
+		}
+
+		data, err := s.client.Get(ctx, key).Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var record idempotencyRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, err
+		}
+		return &record, nil
+	}
+	return nil, fmt.Errorf("key %q keeps expiring", key)
+}
+
+func (s *redisIdempotencyStore) Complete(ctx context.Context, key string, record idempotencyRecord, ttl time.Duration) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, key, data, ttl).Err()
+}
+
+func (s *redisIdempotencyStore) Release(ctx context.Context, key string) error {
+	return s.client.Del(ctx, key).Err()
+}
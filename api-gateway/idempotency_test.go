@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var testIdempotency = IdempotencyConfig{Enabled: true}.withDefaults()
+
+// idempotencyRouter proxies POST /api/tasks to u for user 7 with
+// idempotency keys enabled.
+func idempotencyRouter(t *testing.T, u *upstream) (*gin.Engine, *memoryIdempotencyStore) {
+	t.Helper()
+
+	store := newMemoryIdempotencyStore()
+	t.Cleanup(func() { store.Close() })
+	g := &APIGateway{idempotency: store}
+
+	r := gin.New()
+	r.POST("/api/tasks", func(c *gin.Context) {
+		c.Set(ctxUserID, int64(7))
+		finish, ok := g.idempotent(c, testIdempotency)
+		if !ok {
+			return
+		}
+		defer finish()
+		u.proxy.ServeHTTP(c.Writer, c.Request)
+	})
+	return r, store
+}
+
+func idempotentRequest(key, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/api/tasks", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set(headerIdempotencyKey, key)
+	}
+	return req
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		secondKey  string
+		secondBody string
+		wantStatus int
+		wantHits   int32
+		replayed   bool
+	}{
+		{"replays first response", http.StatusCreated, `{"id":1}`, "k1", `{"title":"a"}`, http.StatusCreated, 1, true},
+		{"replays response without body", http.StatusNoContent, "", "k1", `{"title":"a"}`, http.StatusNoContent, 1, true},
+		{"replays client errors", http.StatusBadRequest, `{"error":"bad"}`, "k1", `{"title":"a"}`, http.StatusBadRequest, 1, true},
+		{"different body", http.StatusCreated, `{"id":1}`, "k1", `{"title":"b"}`, http.StatusUnprocessableEntity, 1, false},
+		{"different key", http.StatusCreated, `{"id":1}`, "k2", `{"title":"a"}`, http.StatusCreated, 2, false},
+		{"no key", http.StatusCreated, `{"id":1}`, "", `{"title":"a"}`, http.StatusCreated, 2, false},
+		// The service may have written before failing
+		{"replays server errors", http.StatusServiceUnavailable, `{"error":"down"}`, "k1", `{"title":"a"}`, http.StatusServiceUnavailable, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits atomic.Int32
+			u := newTestUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Location", "/api/tasks/1")
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}), nil)
+			r, _ := idempotencyRouter(t, u)
+
+			firstKey := "k1"
+			if tt.secondKey == "" {
+				firstKey = ""
+			}
+			first := doRequest(r, idempotentRequest(firstKey, `{"title":"a"}`))
+			if first.Code != tt.status {
+				t.Fatalf("first status = %d, want %d", first.Code, tt.status)
+			}
+
+			second := doRequest(r, idempotentRequest(tt.secondKey, tt.secondBody))
+			if second.Code != tt.wantStatus {
+				t.Errorf("second status = %d, want %d", second.Code, tt.wantStatus)
+			}
+			if got := hits.Load(); got != tt.wantHits {
+				t.Errorf("upstream hits = %d, want %d", got, tt.wantHits)
+			}
+			if replayed := second.Header().Get(headerReplayed) == "true"; replayed != tt.replayed {
+				t.Errorf("replayed = %v, want %v", replayed, tt.replayed)
+			}
+			if tt.replayed {
+				if second.Body.String() != first.Body.String() {
+					t.Errorf("replayed body = %q, want %q", second.Body.String(), first.Body.String())
+				}
+				if got := second.Header().Get("Location"); got != "/api/tasks/1" {
+					t.Errorf("replayed Location = %q", got)
+				}
+			}
+		})
+	}
+}
+
+func TestIdempotentInProgress(t *testing.T) {
+	var hits atomic.Int32
+	u := newTestUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusCreated)
+	}), nil)
+	r, store := idempotencyRouter(t, u)
+
+	// A completed request under another key yields the fingerprint
+	doRequest(r, idempotentRequest("probe", `{"title":"a"}`))
+	fingerprint := store.entries["idempotency:user:7:probe"].record.Fingerprint
+
+	// Claim the key as a request still being proxied would
+	if _, err := store.Begin(context.Background(), "idempotency:user:7:k1", fingerprint, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	w := doRequest(r, idempotentRequest("k1", `{"title":"a"}`))
+	if w.Code != http.StatusConflict {
+		t.Errorf("status = %d, want 409", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Retry-After = %q, want 1", w.Header().Get("Retry-After"))
+	}
+	if hits.Load() != 1 {
+		t.Errorf("upstream hits = %d, want 1", hits.Load())
+	}
+}
+
+// A client that disconnects while its request is at the service retries
+// with the same key. The request must still complete and the retry get its
+// response rather than create a second task.
+func TestIdempotentClientDisconnect(t *testing.T) {
+	var hits atomic.Int32
+	arrived := make(chan struct{})
+	proceed := make(chan struct{})
+	u := newTestUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		hits.Add(1)
+		close(arrived)
+		<-proceed
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"id":1}`)
+	}), nil)
+	r, _ := idempotencyRouter(t, u)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		doRequest(r, idempotentRequest("k1", `{"title":"a"}`).WithContext(ctx))
+	}()
+	<-arrived
+	cancel()
+	// Give a cancelled proxy time to abort before the service answers
+	time.Sleep(50 * time.Millisecond)
+	close(proceed)
+	<-done
+
+	w := doRequest(r, idempotentRequest("k1", `{"title":"a"}`))
+	if got := hits.Load(); got != 1 {
+		t.Errorf("upstream hits = %d, want 1", got)
+	}
+	if w.Code != http.StatusCreated || w.Body.String() != `{"id":1}` {
+		t.Errorf("retry = %d %q, want the stored 201", w.Code, w.Body.String())
+	}
+	if w.Header().Get(headerReplayed) != "true" {
+		t.Error("retry was not replayed")
+	}
+}
+
+// A request the gateway could not send anywhere is safe to retry.
+func TestIdempotentNotSent(t *testing.T) {
+	var hits atomic.Int32
+	u := newTestUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusCreated)
+	}), nil)
+	r, _ := idempotencyRouter(t, u)
+
+	u.backends[0].healthy.Store(false)
+	if w := doRequest(r, idempotentRequest("k1", `{"title":"a"}`)); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", w.Code)
+	}
+	u.backends[0].healthy.Store(true)
+
+	w := doRequest(r, idempotentRequest("k1", `{"title":"a"}`))
+	if w.Code != http.StatusCreated || w.Header().Get(headerReplayed) != "" {
+		t.Errorf("retry = %d replayed %q, want a fresh 201", w.Code, w.Header().Get(headerReplayed))
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("upstream hits = %d, want 1", got)
+	}
+}
+
+// When the service may have acted on a request without answering, retries
+// are held off rather than repeating it.
+func TestIdempotentUnknownOutcome(t *testing.T) {
+	var hits atomic.Int32
+	u := newTestUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}), nil)
+	r, _ := idempotencyRouter(t, u)
+
+	if w := doRequest(r, idempotentRequest("k1", `{"title":"a"}`)); w.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", w.Code)
+	}
+	if w := doRequest(r, idempotentRequest("k1", `{"title":"a"}`)); w.Code != http.StatusConflict {
+		t.Errorf("retry status = %d, want 409", w.Code)
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("upstream hits = %d, want 1", got)
+	}
+}
+
+func TestIdempotencyApplies(t *testing.T) {
+	tests := []struct {
+		route RouteConfig
+		want  bool
+	}{
+		{RouteConfig{Method: http.MethodPost, Auth: true}, true},
+		{RouteConfig{Method: http.MethodDelete, Auth: true}, true},
+		{RouteConfig{Method: http.MethodGet, Auth: true}, false},
+		{RouteConfig{Method: http.MethodPost}, false},
+		{RouteConfig{Method: http.MethodPost, Auth: true, Stream: true}, false},
+	}
+	for _, tt := range tests {
+		if got := testIdempotency.applies(tt.route); got != tt.want {
+			t.Errorf("applies(%s auth=%v stream=%v) = %v, want %v",
+				tt.route.Method, tt.route.Auth, tt.route.Stream, got, tt.want)
+		}
+	}
+}
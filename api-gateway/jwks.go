@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const jwksPath = "/.well-known/jwks.json"
+
+// The key set is refreshed periodically, and on demand when a token names an
+// unknown kid so newly rotated keys are picked up immediately. On-demand
+// fetches are throttled so forged kids cannot hammer user-service.
+const (
+	jwksRefreshInterval = 5 * time.Minute
+	jwksMinRefetch      = 5 * time.Second
+)
+
+// jwtAlgorithms are the only signing algorithms accepted on access tokens.
+var jwtAlgorithms = []string{"RS256", "EdDSA"}
+
+var errUnknownKey = errors.New("unknown signing key")
+
+type verificationKey struct {
+	alg    string
+	public crypto.PublicKey
+}
+
+// jwksCache holds the verification keys published by user-service, by kid.
+type jwksCache struct {
+	mu   sync.RWMutex
+	keys map[string]verificationKey
+
+	// fetchMu serialises fetches; lastFetch is guarded by it
+	fetchMu   sync.Mutex
+	lastFetch time.Time
+}
+
+// verificationKey returns the key for kid, refetching the key set once if
+// the kid is not known yet.
+func (g *APIGateway) verificationKey(ctx context.Context, kid string) (verificationKey, error) {
+	if key, ok := g.jwks.lookup(kid); ok {
+		return key, nil
+	}
+
+	g.jwks.fetchMu.Lock()
+	defer g.jwks.fetchMu.Unlock()
+
+	// Another request may have fetched while we waited
+	if key, ok := g.jwks.lookup(kid); ok {
+		return key, nil
+	}
+	if time.Since(g.jwks.lastFetch) < jwksMinRefetch {
+		return verificationKey{}, errUnknownKey
+	}
+	if err := g.fetchJWKSLocked(ctx); err != nil {
+		return verificationKey{}, err
+	}
+	if key, ok := g.jwks.lookup(kid); ok {
+		return key, nil
+	}
+	return verificationKey{}, errUnknownKey
+}
+
+func (jc *jwksCache) lookup(kid string) (verificationKey, bool) {
+	jc.mu.RLock()
+	defer jc.mu.RUnlock()
+	key, ok := jc.keys[kid]
+	return key, ok
+}
+
+// refreshJWKS replaces the cached key set with the one user-service
+// currently publishes.
+func (g *APIGateway) refreshJWKS(ctx context.Context) error {
+	g.jwks.fetchMu.Lock()
+	defer g.jwks.fetchMu.Unlock()
+	return g.fetchJWKSLocked(ctx)
+}
+
+func (g *APIGateway) fetchJWKSLocked(ctx context.Context) error {
+	g.jwks.lastFetch = time.Now()
+
+	keys, err := g.fetchJWKS(ctx)
+	if err != nil {
+		return fmt.Errorf("fetch jwks: %w", err)
+	}
+	if len(keys) == 0 {
+		return errors.New("fetch jwks: no usable keys")
+	}
+
+	g.jwks.mu.Lock()
+	g.jwks.keys = keys
+	g.jwks.mu.Unlock()
+	return nil
+}
+
+// watchJWKS keeps the key set fresh so keys retired by user-service stop
+// being accepted.
+func (g *APIGateway) watchJWKS(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := g.refreshJWKS(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("jwks refresh failed, keeping cached keys", "error", err)
+		}
+	}
+}
+
+func (g *APIGateway) fetchJWKS(ctx context.Context) (map[string]verificationKey, error) {
+	g.mu.RLock()
+	u := g.services[identityService]
+	g.mu.RUnlock()
+	if u == nil {
+		return nil, fmt.Errorf("service %q is not configured", identityService)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+u.name+jwksPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]verificationKey{}
+	for _, k := range set.Keys {
+		key, err := k.verificationKey()
+		if err != nil {
+			slog.Warn("ignoring jwks key", "kid", k.Kid, "error", err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+// jwk is a public key in JSON Web Key format (RFC 7517).
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+}
+
+// verificationKey decodes the key and pins it to the algorithm it is
+// published for.
+func (k jwk) verificationKey() (verificationKey, error) {
+	if k.Kid == "" {
+		return verificationKey{}, errors.New("missing kid")
+	}
+	if k.Use != "" && k.Use != "sig" {
+		return verificationKey{}, fmt.Errorf("unsupported use %q", k.Use)
+	}
+
+	switch {
+	case k.Kty == "RSA" && (k.Alg == "RS256" || k.Alg == ""):
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			return verificationKey{}, errors.New("invalid RSA key")
+		}
+		public := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if public.N.BitLen() < 2048 {
+			return verificationKey{}, errors.New("RSA key shorter than 2048 bits")
+		}
+		return verificationKey{alg: "RS256", public: public}, nil
+
+	case k.Kty == "OKP" && k.Crv == "Ed25519" && (k.Alg == "EdDSA" || k.Alg == ""):
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return verificationKey{}, errors.New("invalid Ed25519 key")
+		}
+		return verificationKey{alg: "EdDSA", public: ed25519.PublicKey(x)}, nil
+	}
+
+	return verificationKey{}, fmt.Errorf("unsupported key type %q with alg %q", k.Kty, k.Alg)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const headerRequestID = "X-Request-ID"
+
+// Context keys set by the proxy for the access log
+const (
+	ctxRequestID = "request_id"
+	ctxUpstream  = "upstream"
+)
+
+// setupLogging routes both slog and the standard logger through a JSON
+// handler on stdout.
+func setupLogging() {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+}
+
+// requestID propagates the client's X-Request-ID or generates a new one, and
+// forwards it to the upstream and back to the client.
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(headerRequestID)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		c.Request.Header.Set(headerRequestID, id)
+		c.Writer.Header().Set(headerRequestID, id)
+		c.Set(ctxRequestID, id)
+		c.Next()
+	}
+}
+
+// validRequestID accepts short printable IDs so clients cannot inject
+// arbitrary data into logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		if r < 0x21 || r > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// accessLog writes one structured line per request, replacing gin's logger.
+func accessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		path := c.Request.URL.Path
+		c.Next()
+
+		attrs := []any{
+			"request_id", c.GetString(ctxRequestID),
+			"method", c.Request.Method,
+			"path", path,
+			"route", c.FullPath(),
+			"status", c.Writer.Status(),
+			"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+			"bytes", c.Writer.Size(),
+			"client_ip", c.ClientIP(),
+		}
+		if userID, ok := c.Get(ctxUserID); ok {
+			attrs = append(attrs, "user_id", userID)
+		}
+		if keyID, ok := c.Get(ctxAPIKeyID); ok {
+			attrs = append(attrs, "api_key_id", keyID)
+		}
+		if upstream := c.GetString(ctxUpstream); upstream != "" {
+			attrs = append(attrs, "upstream", upstream)
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, "errors", c.Errors.String())
+		}
+
+		slog.Info("request", attrs...)
+	}
+}
@@ -1,61 +1,101 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-type ServiceConfig struct {
-	Name    string
-	BaseURL string
-}
+// Identity headers injected by the gateway after the token has been verified.
+// Downstream services trust these instead of identity fields in request bodies.
+const (
+	headerUserID    = "X-User-ID"
+	headerUserRoles = "X-User-Roles"
+	// "true" once the caller has verified their email address, else "false"
+	headerEmailVerified = "X-Email-Verified"
+	// ID and expiry (Unix time) of the bearer token, used for logout
+	headerTokenID      = "X-Token-ID"
+	headerTokenExpires = "X-Token-Expires"
+)
+
+var identityHeaders = []string{headerUserID, headerUserRoles, headerEmailVerified, headerTokenID, headerTokenExpires}
+
+// Context keys for the verified caller identity
+const (
+	ctxUserID        = "user_id"
+	ctxRoles         = "roles"
+	ctxEmailVerified = "email_verified"
+)
+
+// identityService is the upstream that issues tokens and API keys.
+const identityService = "users"
+
+// Roles issued by user-service
+const (
+	roleAdmin   = "admin"
+	roleManager = "manager"
+	roleMember  = "member"
+)
 
 type APIGateway struct {
-	services  map[string]*httputil.ReverseProxy
-	jwtSecret []byte
+	configPath  string
+	limiter     RateLimiter
+	idempotency IdempotencyStore
+	cache       *responseCache
+	signer      *internalSigner
+
+	mu       sync.RWMutex
+	config   *GatewayConfig
+	services map[string]*upstream
+	router   http.Handler
+
+	openAPI openAPICache
+	apiKeys apiKeyCache
+	jwks    jwksCache
+
+	revocations revocationCache
+
+	// streams is cancelled by closeStreams to end open stream connections
+	streams      context.Context
+	closeStreams context.CancelFunc
 }
 
-func NewAPIGateway(jwtSecret string) *APIGateway {
+func NewAPIGateway(configPath string, signer *internalSigner, limiter RateLimiter, idempotency IdempotencyStore, cache *responseCache) *APIGateway {
+	streams, closeStreams := context.WithCancel(context.Background())
 	return &APIGateway{
-		services: map[string]*httputil.ReverseProxy{
-			"users":         createReverseProxy(os.Getenv("USER_URL")),
-			"tasks":         createReverseProxy(os.Getenv("TASKS_URL")),
-			"assignments":   createReverseProxy(os.Getenv("ASSIGNMENTS_URL")),
-			"notifications": createReverseProxy(os.Getenv("NOTIFICATIONS_URL")),
-			"dashboard":     createReverseProxy(os.Getenv("DASHBOARD_URL")),
-		},
-		jwtSecret: []byte(jwtSecret),
+		configPath:   configPath,
+		limiter:      limiter,
+		idempotency:  idempotency,
+		cache:        cache,
+		signer:       signer,
+		config:       &GatewayConfig{},
+		services:     map[string]*upstream{},
+		router:       http.NotFoundHandler(),
+		streams:      streams,
+		closeStreams: closeStreams,
 	}
 }
 
-func createReverseProxy(targetURL string) *httputil.ReverseProxy {
-	url, err := url.Parse(targetURL)
-	if err != nil {
-		log.Fatalf("Invalid URL: %v", err)
-	}
-
-	proxy := httputil.NewSingleHostReverseProxy(url)
-
-	// Error handling
-	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		log.Printf("Proxy error: %v", err)
-		w.WriteHeader(http.StatusBadGateway)
-		w.Write([]byte("Bad Gateway: " + err.Error()))
+// authenticateRequest accepts either a Bearer JWT or an API key in the
+// X-API-Key header and forwards the verified identity.
+func (g *APIGateway) authenticateRequest(c *gin.Context) bool {
+	if key := c.GetHeader(headerAPIKey); key != "" {
+		return g.authenticateAPIKey(c, key)
 	}
 
-	return proxy
-}
-
-func (g *APIGateway) authenticateRequest(c *gin.Context) bool {
 	authHeader := c.GetHeader("Authorization")
 	if authHeader == "" {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header missing"})
@@ -66,10 +106,19 @@ func (g *APIGateway) authenticateRequest(c *gin.Context) bool {
 	// Remove "Bearer " prefix
 	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 
-	// Parse and validate JWT token
+	// Verify against the key named by kid; the algorithm is pinned both
+	// globally and to the one the key was published for
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return g.jwtSecret, nil
-	})
+		kid, _ := token.Header["kid"].(string)
+		key, err := g.verificationKey(c.Request.Context(), kid)
+		if err != nil {
+			return nil, err
+		}
+		if token.Method.Alg() != key.alg {
+			return nil, fmt.Errorf("key %s does not accept alg %s", kid, token.Method.Alg())
+		}
+		return key.public, nil
+	}, jwt.WithValidMethods(jwtAlgorithms), jwt.WithExpirationRequired())
 
 	if err != nil || !token.Valid {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
@@ -77,123 +126,321 @@ func (g *APIGateway) authenticateRequest(c *gin.Context) bool {
 		return false
 	}
 
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+		c.Abort()
+		return false
+	}
+
+	// JSON numbers decode as float64
+	userID, ok := claims["user_id"].(float64)
+	jti, _ := claims["jti"].(string)
+	issuedAt, errIat := claims.GetIssuedAt()
+	expires, errExp := claims.GetExpirationTime()
+	if !ok || userID <= 0 || jti == "" || errIat != nil || issuedAt == nil || errExp != nil ||
+		expires.Sub(issuedAt.Time) > maxTokenLifetime {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+		c.Abort()
+		return false
+	}
+
+	if g.tokenRevoked(jti, int64(userID), issuedAt.Time) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Token revoked"})
+		c.Abort()
+		return false
+	}
+
+	// Tokens without the claim predate email verification
+	emailVerified, _ := claims["email_verified"].(bool)
+	g.setIdentity(c, int64(userID), claimRoles(claims), emailVerified)
+	c.Request.Header.Set(headerTokenID, jti)
+	c.Request.Header.Set(headerTokenExpires, strconv.FormatInt(expires.Unix(), 10))
 	return true
 }
 
-func (g *APIGateway) proxyRequest(serviceName string, requireAuth bool) gin.HandlerFunc {
+// setIdentity records the verified caller and forwards it to downstream
+// services.
+func (g *APIGateway) setIdentity(c *gin.Context, userID int64, roles []string, emailVerified bool) {
+	c.Set(ctxUserID, userID)
+	c.Set(ctxRoles, roles)
+	c.Set(ctxEmailVerified, emailVerified)
+	c.Request.Header.Set(headerUserID, strconv.FormatInt(userID, 10))
+	if len(roles) > 0 {
+		c.Request.Header.Set(headerUserRoles, strings.Join(roles, ","))
+	}
+	c.Request.Header.Set(headerEmailVerified, strconv.FormatBool(emailVerified))
+}
+
+// requireVerified rejects callers who have not verified their email
+// address. It must run after authenticateRequest.
+func (g *APIGateway) requireVerified(c *gin.Context) bool {
+	if c.GetBool(ctxEmailVerified) {
+		return true
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": "Email address not verified"})
+	c.Abort()
+	return false
+}
+
+// requireOwner rejects callers other than the user named by the path
+// parameter param, unless they are an admin. It must run after
+// authenticateRequest.
+func (g *APIGateway) requireOwner(c *gin.Context, param string) bool {
+	if c.Param(param) == strconv.FormatInt(c.GetInt64(ctxUserID), 10) ||
+		slices.Contains(c.GetStringSlice(ctxRoles), roleAdmin) {
+		return true
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+	c.Abort()
+	return false
+}
+
+// authorizeRequest checks the caller's roles against the roles allowed on the
+// route. Routes without roles are open to every authenticated user. API key
+// callers must also hold every scope the route requires; routes without
+// scopes do not accept API keys. It must run after authenticateRequest.
+func (g *APIGateway) authorizeRequest(c *gin.Context, allowed, scopes []string) bool {
+	if granted, ok := c.Get(ctxScopes); ok && (len(scopes) == 0 || !hasScopes(granted.([]string), scopes)) {
+		slog.Warn("access denied",
+			"request_id", c.GetString(ctxRequestID),
+			"user_id", c.GetInt64(ctxUserID),
+			"api_key_id", c.GetInt64(ctxAPIKeyID),
+			"scopes", granted,
+			"route", c.Request.Method+" "+c.FullPath())
+		if len(scopes) == 0 {
+			c.JSON(http.StatusForbidden, gin.H{"error": "API keys are not accepted on this route"})
+		} else {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":           "Insufficient scope",
+				"required_scopes": scopes,
+			})
+		}
+		c.Abort()
+		return false
+	}
+
+	if len(allowed) == 0 {
+		return true
+	}
+
+	roles := c.GetStringSlice(ctxRoles)
+	for _, role := range roles {
+		for _, a := range allowed {
+			if role == a {
+				return true
+			}
+		}
+	}
+
+	slog.Warn("access denied",
+		"request_id", c.GetString(ctxRequestID),
+		"user_id", c.GetInt64(ctxUserID),
+		"roles", roles,
+		"route", c.Request.Method+" "+c.FullPath())
+	c.JSON(http.StatusForbidden, gin.H{
+		"error":          "Insufficient permissions",
+		"required_roles": allowed,
+	})
+	c.Abort()
+	return false
+}
+
+// requireRoles guards gateway-owned endpoints with the same checks as
+// proxied routes.
+func (g *APIGateway) requireRoles(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, h := range identityHeaders {
+			c.Request.Header.Del(h)
+		}
+		if !g.authenticateRequest(c) || !g.authorizeRequest(c, roles, nil) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// claimRoles extracts the "roles" claim as a list of strings.
+func claimRoles(claims jwt.MapClaims) []string {
+	raw, ok := claims["roles"].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	roles := make([]string, 0, len(raw))
+	for _, r := range raw {
+		if role, ok := r.(string); ok && role != "" {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+func (g *APIGateway) proxyRequest(route RouteConfig, upstream *upstream) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		c.Set(ctxUpstream, route.Service)
+
+		if !applyVersion(c, route) {
+			return
+		}
+
+		if route.Stream {
+			if inBatch(c.Request) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Stream routes cannot be batched"})
+				return
+			}
+			tokenFromQuery(c.Request)
+		} else if isUpgrade(c.Request) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Protocol upgrade not supported on this route"})
+			return
+		} else if route.QueryToken {
+			tokenFromQuery(c.Request)
+		}
+
+		// Never trust identity headers supplied by the client
+		for _, h := range identityHeaders {
+			c.Request.Header.Del(h)
+		}
+
+		if route.limit != nil && !g.rateLimitIP(c, route.RateLimit, *route.limit) {
+			return
+		}
 
 		// Skip authentication for public routes
-		if requireAuth {
+		if route.Auth {
 			if !g.authenticateRequest(c) {
 				return
 			}
+			if !g.authorizeRequest(c, route.Roles, route.Scopes) {
+				return
+			}
+			if route.RequireVerified && !g.requireVerified(c) {
+				return
+			}
+			if route.OwnerParam != "" && !g.requireOwner(c, route.OwnerParam) {
+				return
+			}
+		}
+
+		// API keys are long-lived secrets; never pass them on
+		c.Request.Header.Del(headerAPIKey)
+
+		if route.limit != nil && !g.rateLimitUser(c, route.RateLimit, *route.limit) {
+			return
 		}
 
-		proxy, exists := g.services[serviceName]
-		if !exists {
+		if upstream == nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Service not found"})
 			return
 		}
 
-		proxy.ServeHTTP(c.Writer, c.Request)
+		if route.idempotency != nil {
+			finish, ok := g.idempotent(c, *route.idempotency)
+			if !ok {
+				return
+			}
+			defer finish()
+		}
+
+		if route.Rewrite != "" {
+			c.Request.URL.Path = rewritePath(route.Rewrite, c.Params)
+			c.Request.URL.RawPath = ""
+		}
+
+		if route.transform != nil {
+			c.Request = route.transform.applyRequest(c.Request)
+		}
+
+		if route.Cache != nil && !g.lookupCache(c, route) {
+			return
+		}
+
+		if route.Stream {
+			ctx, done := g.openStream(c, route.IdleTimeout)
+			defer done()
+			defer recoverClosedStream(ctx)
+			c.Request = c.Request.WithContext(ctx)
+		}
+
+		upstream.proxy.ServeHTTP(c.Writer, c.Request)
 	}
 }
 
 func main() {
+	setupLogging()
 
 	err := godotenv.Load(".env")
 	if err != nil {
 		log.Fatalf("Error loading .env file: %v", err)
 	}
 
-	gateway := NewAPIGateway(os.Getenv("JWT_SECRET_KEY"))
-
-	r := gin.Default()
-
-	// CORS Middleware
-	r.Use(func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
-		}
-
-		c.Next()
-	})
-
-	// User Service Routes
-	userRoutes := r.Group("/api/users")
-	{
-		// Public routes (no authentication required)
-		userRoutes.POST("/register", gateway.proxyRequest("users", false))
-		userRoutes.POST("/login", gateway.proxyRequest("users", false))
-		// Protected routes
-		userRoutes.GET("/profile/:id", gateway.proxyRequest("users", true))
+	configPath := os.Getenv("GATEWAY_CONFIG")
+	if configPath == "" {
+		configPath = "routes.yaml"
 	}
 
-	// Web Routes for User Service
-	r.GET("/register", gateway.proxyRequest("users", false))
-	r.GET("/login", gateway.proxyRequest("users", false))
-	r.GET("/profile", gateway.proxyRequest("users", false))
-
-	// Task Creation Routes
-	taskRoutes := r.Group("/api/tasks")
-	{
-		taskRoutes.POST("", gateway.proxyRequest("tasks", true))
-		taskRoutes.GET("", gateway.proxyRequest("tasks", true))
-		taskRoutes.GET("/:id", gateway.proxyRequest("tasks", true))
-		taskRoutes.PUT("/:id", gateway.proxyRequest("tasks", true))
-		taskRoutes.DELETE("/:id", gateway.proxyRequest("tasks", true))
+	signer, err := newInternalSigner(os.Getenv("INTERNAL_TOKEN_SECRET"))
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	// Task Assignment Routes
-	assignmentRoutes := r.Group("/api/assignments")
-	{
-		assignmentRoutes.POST("/assign", gateway.proxyRequest("assignments", true))
-		assignmentRoutes.GET("/user/:user_id", gateway.proxyRequest("assignments", true))
-		assignmentRoutes.PUT("/:id/status", gateway.proxyRequest("assignments", true))
-		assignmentRoutes.GET("", gateway.proxyRequest("assignments", true))
+	limiter, err := newRateLimiter(os.Getenv("REDIS_URL"))
+	if err != nil {
+		log.Fatalf("Rate limiter setup failed: %v", err)
 	}
-
-	// Notification Routes
-	notificationRoutes := r.Group("/api/notifications")
-	{
-		notificationRoutes.POST("/send", gateway.proxyRequest("notifications", true))
-		notificationRoutes.GET("/user/:user_id", gateway.proxyRequest("notifications", true))
-		notificationRoutes.PUT("/:id/read", gateway.proxyRequest("notifications", true))
+	idempotency, err := newIdempotencyStore(os.Getenv("REDIS_URL"))
+	if err != nil {
+		log.Fatalf("Idempotency store setup failed: %v", err)
+	}
+	cache, err := newResponseCache(os.Getenv("REDIS_URL"))
+	if err != nil {
+		log.Fatalf("Response cache setup failed: %v", err)
 	}
 
-	// Dashboard Routes
-	dashboardRoutes := r.Group("/api/dashboard")
-	{
-		dashboardRoutes.GET("/:user_id", gateway.proxyRequest("dashboard", true))
-		dashboardRoutes.GET("/:user_id/tasks", gateway.proxyRequest("dashboard", true))
+	stop, deadline := shutdownContexts()
+
+	gateway := NewAPIGateway(configPath, signer, limiter, idempotency, cache)
+	prometheus.MustRegister(upstreamCollector{g: gateway})
+	if err := gateway.Reload(); err != nil {
+		log.Fatalf("Invalid gateway configuration: %v", err)
 	}
+	go gateway.watchConfig(stop, 5*time.Second)
 
-	// Web Routes for Dashboard Service
-	r.GET("/tasks/:id", gateway.proxyRequest("dashboard", false))
+	// Tokens cannot be verified until the key set is loaded; it is retried
+	// on the first token and by the refresh loop if user-service is not up yet.
+	if err := gateway.refreshJWKS(stop); err != nil {
+		slog.Warn("initial jwks fetch failed", "error", err)
+	}
+	go gateway.watchJWKS(stop, jwksRefreshInterval)
 
-	r.GET("/routes", func(c *gin.Context) {
-		routes := []string{}
-		for _, ri := range r.Routes() {
-			routes = append(routes, ri.Method+" "+ri.Path)
-		}
-		c.JSON(http.StatusOK, routes)
-	})
+	if err := gateway.syncRevocations(stop); err != nil {
+		slog.Warn("initial revocation sync failed", "error", err)
+	}
+	go gateway.watchRevocations(stop, revocationPollInterval)
+	go cache.watchInvalidations(stop)
+	go serveMetrics(stop, deadline)
 
-	// Start server
+	// Start server. Stream routes lift the read and write timeouts for their
+	// own connections.
 	server := &http.Server{
 		Addr:           ":8080",
-		Handler:        r,
+		Handler:        gateway,
 		ReadTimeout:    10 * time.Second,
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
 
+	// Open streams would hold up draining until the deadline
+	server.RegisterOnShutdown(gateway.closeStreams)
+
 	log.Println("API Gateway running on :8080")
-	log.Fatal(server.ListenAndServe())
+	if err := serve(stop, deadline, server); err != nil {
+		log.Fatalf("Server failed: %v", err)
+	}
+
+	gateway.Close()
+	limiter.Close()
+	idempotency.Close()
+	cache.Close()
+	log.Println("API Gateway stopped")
 }
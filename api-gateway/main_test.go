@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newTestUpstream proxies to a test server running h. Responses are cached
+// in cache when it is not nil.
+func newTestUpstream(t *testing.T, h http.Handler, cache *responseCache) *upstream {
+	t.Helper()
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	signer, err := newInternalSigner(strings.Repeat("s", minInternalSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache == nil {
+		cache = newTestCache(t)
+	}
+	u, err := newUpstream(ServiceConfig{Name: "test", BaseURL: srv.URL}.withDefaults(), signer, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func newTestCache(t *testing.T) *responseCache {
+	t.Helper()
+
+	cache, err := newResponseCache("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+// doRequest sends a request through h and returns the recorded response.
+func doRequest(h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(closeNotifyRecorder{w}, req)
+	return w
+}
+
+// closeNotifyRecorder satisfies the http.CloseNotifier that gin's writer
+// asserts when httputil.ReverseProxy asks for it.
+type closeNotifyRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (closeNotifyRecorder) CloseNotify() <-chan bool {
+	return make(chan bool)
+}
+
+func TestRequireOwner(t *testing.T) {
+	tests := []struct {
+		name   string
+		userID int64
+		roles  []string
+		path   string
+		want   int
+	}{
+		{"own ID", 7, []string{"member"}, "/tasks/7", http.StatusOK},
+		{"other user's ID", 7, []string{"member"}, "/tasks/8", http.StatusForbidden},
+		{"manager", 7, []string{"manager"}, "/tasks/8", http.StatusForbidden},
+		{"admin", 7, []string{"admin"}, "/tasks/8", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &APIGateway{}
+			r := gin.New()
+			r.GET("/tasks/:id", func(c *gin.Context) {
+				c.Set(ctxUserID, tt.userID)
+				c.Set(ctxRoles, tt.roles)
+				if g.requireOwner(c, "id") {
+					c.Status(http.StatusOK)
+				}
+			})
+			if w := doRequest(r, httptest.NewRequest(http.MethodGet, tt.path, nil)); w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoutesConfig(t *testing.T) {
+	for _, name := range []string{"USER_URL", "TASKS_URL", "ASSIGNMENTS_URL", "NOTIFICATIONS_URL", "DASHBOARD_URL"} {
+		t.Setenv(name, "http://localhost:1")
+	}
+	if _, err := loadConfig("routes.yaml"); err != nil {
+		t.Fatal(err)
+	}
+}
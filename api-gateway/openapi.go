@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openAPICacheTTL bounds how stale the merged document can get when a
+// service is redeployed with a new spec.
+const openAPICacheTTL = time.Minute
+
+// openAPIDoc holds the parts of a service document the gateway merges.
+type openAPIDoc struct {
+	Paths      map[string]map[string]map[string]any `json:"paths"`
+	Components struct {
+		Schemas map[string]json.RawMessage `json:"schemas"`
+	} `json:"components"`
+}
+
+// openAPICache holds the merged document for the current configuration.
+type openAPICache struct {
+	mu      sync.Mutex
+	spec    []byte
+	builtAt time.Time
+}
+
+func (oc *openAPICache) invalidate() {
+	oc.mu.Lock()
+	oc.spec = nil
+	oc.mu.Unlock()
+}
+
+// serveOpenAPI returns the merged OpenAPI document for the gateway's routes.
+func (g *APIGateway) serveOpenAPI(c *gin.Context) {
+	g.openAPI.mu.Lock()
+	defer g.openAPI.mu.Unlock()
+
+	if g.openAPI.spec == nil || time.Since(g.openAPI.builtAt) > openAPICacheTTL {
+		spec, err := g.buildOpenAPI(c.Request.Context())
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build API specification"})
+			return
+		}
+		g.openAPI.spec = spec
+		g.openAPI.builtAt = time.Now()
+	}
+
+	c.Data(http.StatusOK, "application/json", g.openAPI.spec)
+}
+
+// buildOpenAPI fetches every service's document and re-keys the operations
+// by the gateway path they are exposed on. Routes whose upstream operation is
+// missing from the service document are listed under x-undocumented-routes.
+func (g *APIGateway) buildOpenAPI(ctx context.Context) ([]byte, error) {
+	g.mu.RLock()
+	cfg := g.config
+	services := g.services
+	g.mu.RUnlock()
+
+	docs := map[string]*openAPIDoc{}
+	for name, u := range services {
+		doc, err := fetchOpenAPI(ctx, u)
+		if err != nil {
+			slog.Warn("failed to fetch service openapi document", "service", name, "error", err)
+			continue
+		}
+		docs[name] = doc
+	}
+
+	paths := map[string]map[string]any{}
+	schemas := map[string]json.RawMessage{}
+	var undocumented []string
+
+	// The unversioned aliases of the default version are left out; they
+	// behave exactly like its versioned paths.
+	for _, route := range cfg.endpoints {
+		if route.alias {
+			continue
+		}
+		method := strings.ToLower(route.Method)
+		upstreamPath := route.Path
+		if route.versionPrefix != "" {
+			upstreamPath = "/api" + strings.TrimPrefix(route.Path, route.versionPrefix)
+		}
+		if route.Rewrite != "" {
+			upstreamPath = route.Rewrite
+		}
+
+		doc := docs[route.Service]
+		var op map[string]any
+		if doc != nil {
+			op = doc.Paths[openAPIPath(upstreamPath)][method]
+		}
+		if op == nil {
+			undocumented = append(undocumented, route.Method+" "+route.Path)
+			continue
+		}
+
+		op = annotateOperation(op, route)
+		// Operation IDs must stay unique when several versions share one
+		if id, ok := op["operationId"].(string); ok && route.Version != "" && route.Version != cfg.DefaultVersion {
+			op["operationId"] = id + strings.ToUpper(route.Version[:1]) + route.Version[1:]
+		}
+		gatewayPath := openAPIPath(route.Path)
+		if paths[gatewayPath] == nil {
+			paths[gatewayPath] = map[string]any{}
+		}
+		paths[gatewayPath][method] = op
+	}
+
+	// Services share some schema names (Error, Message); keep the first
+	// definition and flag conflicting ones.
+	names := make([]string, 0, len(docs))
+	for name := range docs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, service := range names {
+		for name, schema := range docs[service].Components.Schemas {
+			existing, ok := schemas[name]
+			if ok && !jsonEqual(existing, schema) {
+				slog.Warn("conflicting openapi schema", "schema", name, "service", service)
+				continue
+			}
+			schemas[name] = schema
+		}
+	}
+
+	if len(undocumented) > 0 {
+		sort.Strings(undocumented)
+		slog.Warn("gateway routes missing from service openapi documents", "routes", undocumented)
+	}
+
+	return json.MarshalIndent(map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "Task Management API",
+			"version":     "1.0.0",
+			"description": "Routes exposed by the API gateway, merged from each service's OpenAPI document.",
+		},
+		"servers": []map[string]string{{"url": "/"}},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"bearerAuth": map[string]string{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"apiKeyAuth": map[string]string{"type": "apiKey", "in": "header", "name": headerAPIKey},
+			},
+		},
+		"x-undocumented-routes": undocumented,
+	}, "", "  ")
+}
+
+// annotateOperation copies op and adds the gateway's security and error
+// responses for the route.
+func annotateOperation(op map[string]any, route RouteConfig) map[string]any {
+	out := make(map[string]any, len(op)+1)
+	for k, v := range op {
+		out[k] = v
+	}
+
+	responses := map[string]any{}
+	if existing, ok := op["responses"].(map[string]any); ok {
+		for k, v := range existing {
+			responses[k] = v
+		}
+	}
+	errorRef := map[string]any{"content": map[string]any{"application/json": map[string]any{
+		"schema": map[string]string{"$ref": "#/components/schemas/Error"},
+	}}}
+	addResponse := func(code, description string) {
+		if _, ok := responses[code]; !ok {
+			resp := map[string]any{"description": description}
+			for k, v := range errorRef {
+				resp[k] = v
+			}
+			responses[code] = resp
+		}
+	}
+
+	if route.Auth {
+		security := []map[string][]string{{"bearerAuth": {}}}
+		if len(route.Scopes) > 0 {
+			security = append(security, map[string][]string{"apiKeyAuth": route.Scopes})
+			out["x-required-scopes"] = route.Scopes
+		}
+		out["security"] = security
+		addResponse("401", "Missing or invalid credentials")
+	}
+	if route.RequireVerified {
+		out["x-requires-verified-email"] = true
+	}
+	if len(route.Roles) > 0 || len(route.Scopes) > 0 || route.RequireVerified || route.OwnerParam != "" {
+		if len(route.Roles) > 0 {
+			out["x-required-roles"] = route.Roles
+		}
+		addResponse("403", "Insufficient permissions")
+	}
+	if route.limit != nil {
+		addResponse("429", "Rate limit exceeded")
+	}
+	if v := route.lifecycle; v != nil {
+		if !v.DeprecatedAt.IsZero() {
+			out["deprecated"] = true
+		}
+		if !v.SunsetAt.IsZero() {
+			out["x-sunset"] = v.SunsetAt.UTC().Format(time.RFC3339)
+		}
+	}
+	addResponse("503", "Service temporarily unavailable")
+	out["responses"] = responses
+
+	return out
+}
+
+func fetchOpenAPI(ctx context.Context, u *upstream) (*openAPIDoc, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+u.name+"/openapi.json", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var doc openAPIDoc
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+func jsonEqual(a, b json.RawMessage) bool {
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return false
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+// openAPIPath converts gin path parameters (:id, *path) to OpenAPI ({id}).
+func openAPIPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		if strings.HasPrefix(seg, ":") || strings.HasPrefix(seg, "*") {
+			segments[i] = "{" + seg[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// docsPage renders the merged document with Swagger UI.
+const docsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="utf-8">
+    <title>Task Management API</title>
+    <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+    <div id="swagger-ui"></div>
+    <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+    <script>
+        SwaggerUIBundle({ url: "/openapi.json", dom_id: "#swagger-ui" });
+    </script>
+</body>
+</html>
+`
+
+func serveDocs(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(docsPage))
+}
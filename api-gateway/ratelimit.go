@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimit is a token bucket refilled with Requests tokens every Per,
+// holding at most Burst tokens.
+type RateLimit struct {
+	Requests int           `yaml:"requests"`
+	Per      time.Duration `yaml:"per"`
+	Burst    int           `yaml:"burst"`
+}
+
+func (l RateLimit) capacity() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Requests
+}
+
+// refillRate returns tokens added per second.
+func (l RateLimit) refillRate() float64 {
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+// refillTime returns how long an empty bucket takes to fill up.
+func (l RateLimit) refillTime() time.Duration {
+	return time.Duration(float64(l.capacity()) / l.refillRate() * float64(time.Second))
+}
+
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration // time until the next token, when denied
+	Reset      time.Duration // time until the bucket is full again
+}
+
+// RateLimiter takes one token from the bucket identified by key.
+type RateLimiter interface {
+	Allow(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error)
+	// Close releases background work and connections.
+	Close() error
+}
+
+// newRateLimiter returns a Redis-backed limiter when REDIS_URL is set so that
+// gateway replicas share counters, and an in-memory limiter otherwise.
+func newRateLimiter(redisURL string) (RateLimiter, error) {
+	if redisURL == "" {
+		return newMemoryRateLimiter(), nil
+	}
+
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse REDIS_URL: %w", err)
+	}
+	return &redisRateLimiter{client: redis.NewClient(opts)}, nil
+}
+
+// rateLimitIP enforces a rate limit per client IP. It runs before
+// authentication, so requests with bad credentials are limited too and
+// cannot be used to hammer the API key check in user-service.
+func (g *APIGateway) rateLimitIP(c *gin.Context, name string, limit RateLimit) bool {
+	return g.rateLimit(c, "ratelimit:"+name+":ip:"+c.ClientIP(), limit)
+}
+
+// rateLimitUser enforces a rate limit per authenticated user, so callers
+// sharing an address do not exhaust each other's allowance beyond the IP
+// limit. It must run after authenticateRequest and does nothing for
+// anonymous callers.
+func (g *APIGateway) rateLimitUser(c *gin.Context, name string, limit RateLimit) bool {
+	userID, ok := c.Get(ctxUserID)
+	if !ok {
+		return true
+	}
+	return g.rateLimit(c, fmt.Sprintf("ratelimit:%s:user:%d", name, userID), limit)
+}
+
+// rateLimit takes a token from the bucket under key.
+func (g *APIGateway) rateLimit(c *gin.Context, key string, limit RateLimit) bool {
+	result, err := g.limiter.Allow(c.Request.Context(), key, limit)
+	if err != nil {
+		// Fail open so a limiter outage does not take the gateway down
+		log.Printf("Rate limiter error for %s: %v", key, err)
+		return true
+	}
+
+	h := c.Writer.Header()
+	h.Set("X-RateLimit-Limit", strconv.Itoa(limit.capacity()))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	h.Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+
+	if !result.Allowed {
+		h.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded"})
+		c.Abort()
+		return false
+	}
+	return true
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// takeToken applies the token bucket algorithm to a bucket that held tokens
+// at last. It returns the new token count and the decision.
+func takeToken(tokens float64, last, now time.Time, limit RateLimit) (float64, RateLimitResult) {
+	capacity := float64(limit.capacity())
+	rate := limit.refillRate()
+
+	tokens = math.Min(capacity, tokens+now.Sub(last).Seconds()*rate)
+
+	var result RateLimitResult
+	if tokens >= 1 {
+		tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	result.Remaining = int(tokens)
+	result.Reset = time.Duration((capacity - tokens) / rate * float64(time.Second))
+
+	return tokens, result
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	refill time.Duration // refillTime of the bucket's limit
+}
+
+type memoryRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	done    chan struct{}
+}
+
+func newMemoryRateLimiter() *memoryRateLimiter {
+	l := &memoryRateLimiter{buckets: map[string]*bucket{}, done: make(chan struct{})}
+	go l.cleanup(time.Minute)
+	return l
+}
+
+func (l *memoryRateLimiter) Close() error {
+	close(l.done)
+	return nil
+}
+
+func (l *memoryRateLimiter) Allow(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: float64(limit.capacity()), last: now}
+		l.buckets[key] = b
+	}
+
+	var result RateLimitResult
+	b.tokens, result = takeToken(b.tokens, b.last, now, limit)
+	b.last = now
+	b.refill = limit.refillTime()
+	return result, nil
+}
+
+// cleanup periodically drops buckets that are full again.
+func (l *memoryRateLimiter) cleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case now := <-ticker.C:
+			l.sweep(now)
+		}
+	}
+}
+
+// sweep drops buckets idle long enough to have refilled completely. They
+// would be recreated full, so nothing is lost.
+func (l *memoryRateLimiter) sweep(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= b.refill {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// tokenBucketScript runs the same algorithm as takeToken atomically in Redis.
+// The bucket is stored as a hash of tokens and last refill time in ms.
+var tokenBucketScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2]) / 1000
+local now = tonumber(ARGV[3])
+
+local state = redis.call("HMGET", KEYS[1], "tokens", "last")
+local tokens = tonumber(state[1]) or capacity
+local last = tonumber(state[2]) or now
+
+tokens = math.min(capacity, tokens + math.max(0, now - last) * rate)
+
+local allowed = 0
+local retry_after = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry_after = math.ceil((1 - tokens) / rate)
+end
+local reset = math.ceil((capacity - tokens) / rate)
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "last", now)
+redis.call("PEXPIRE", KEYS[1], reset + 1000)
+
+return {allowed, math.floor(tokens), retry_after, reset}
+`)
+
+type redisRateLimiter struct {
+	client *redis.Client
+}
+
+func (l *redisRateLimiter) Close() error {
+	return l.client.Close()
+}
+
+func (l *redisRateLimiter) Allow(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	res, err := tokenBucketScript.Run(ctx, l.client, []string{key},
+		limit.capacity(), limit.refillRate(), time.Now().UnixMilli()).Int64Slice()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	return RateLimitResult{
+		Allowed:    res[0] == 1,
+		Remaining:  int(res[1]),
+		RetryAfter: time.Duration(res[2]) * time.Millisecond,
+		Reset:      time.Duration(res[3]) * time.Millisecond,
+	}, nil
+}
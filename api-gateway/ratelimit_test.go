@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTakeToken(t *testing.T) {
+	limit := RateLimit{Requests: 10, Per: 10 * time.Second, Burst: 5} // 1 token/s
+	now := time.Now()
+
+	tests := []struct {
+		name          string
+		tokens        float64
+		elapsed       time.Duration
+		wantAllowed   bool
+		wantTokens    float64
+		wantRemaining int
+		wantRetry     time.Duration
+	}{
+		{"full bucket", 5, 0, true, 4, 4, 0},
+		{"last token", 1, 0, true, 0, 0, 0},
+		{"empty bucket", 0, 0, false, 0, 0, time.Second},
+		{"half refilled", 0, 500 * time.Millisecond, false, 0.5, 0, 500 * time.Millisecond},
+		{"refilled one", 0, time.Second, true, 0, 0, 0},
+		{"refill capped at burst", 2, time.Hour, true, 4, 4, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, result := takeToken(tt.tokens, now.Add(-tt.elapsed), now, limit)
+			if result.Allowed != tt.wantAllowed {
+				t.Errorf("allowed = %v, want %v", result.Allowed, tt.wantAllowed)
+			}
+			if diff := tokens - tt.wantTokens; diff > 1e-9 || diff < -1e-9 {
+				t.Errorf("tokens = %v, want %v", tokens, tt.wantTokens)
+			}
+			if result.Remaining != tt.wantRemaining {
+				t.Errorf("remaining = %d, want %d", result.Remaining, tt.wantRemaining)
+			}
+			if result.RetryAfter != tt.wantRetry {
+				t.Errorf("retry after = %v, want %v", result.RetryAfter, tt.wantRetry)
+			}
+		})
+	}
+}
+
+func TestMemoryRateLimiterAllow(t *testing.T) {
+	l := &memoryRateLimiter{buckets: map[string]*bucket{}}
+	limit := RateLimit{Requests: 3, Per: time.Hour}
+
+	for i := 0; i < 3; i++ {
+		if result, _ := l.Allow(context.Background(), "k", limit); !result.Allowed {
+			t.Fatalf("request %d denied", i+1)
+		}
+	}
+	result, _ := l.Allow(context.Background(), "k", limit)
+	if result.Allowed {
+		t.Fatal("request over the limit allowed")
+	}
+	if result.RetryAfter < 19*time.Minute || result.RetryAfter > 20*time.Minute {
+		t.Errorf("retry after = %v, want about 20m", result.RetryAfter)
+	}
+	if result, _ := l.Allow(context.Background(), "other", limit); !result.Allowed {
+		t.Error("separate key shares the bucket")
+	}
+}
+
+func TestMemoryRateLimiterSweep(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    RateLimit
+		idle     time.Duration
+		wantKept bool
+	}{
+		{"short period refilled", RateLimit{Requests: 60, Per: time.Minute}, 2 * time.Minute, false},
+		{"short period refilling", RateLimit{Requests: 60, Per: time.Minute}, 30 * time.Second, true},
+		// Dropping this bucket after a minute would hand out a fresh burst
+		{"long period", RateLimit{Requests: 5, Per: time.Hour}, 2 * time.Minute, true},
+		{"long period refilled", RateLimit{Requests: 5, Per: time.Hour}, time.Hour, false},
+		{"burst above rate", RateLimit{Requests: 1, Per: time.Minute, Burst: 10}, 5 * time.Minute, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &memoryRateLimiter{buckets: map[string]*bucket{}}
+			for i := 0; i < tt.limit.capacity(); i++ {
+				l.Allow(context.Background(), "k", tt.limit)
+			}
+			l.sweep(time.Now().Add(tt.idle))
+
+			if _, kept := l.buckets["k"]; kept != tt.wantKept {
+				t.Errorf("bucket kept = %v, want %v", kept, tt.wantKept)
+			}
+		})
+	}
+}
+
+func TestMemoryRateLimiterSweepKeepsLimit(t *testing.T) {
+	l := &memoryRateLimiter{buckets: map[string]*bucket{}}
+	limit := RateLimit{Requests: 5, Per: time.Hour}
+	for i := 0; i < 5; i++ {
+		l.Allow(context.Background(), "k", limit)
+	}
+
+	// The cleanup runs while the client pauses
+	l.sweep(time.Now().Add(2 * time.Minute))
+
+	if result, _ := l.Allow(context.Background(), "k", limit); result.Allowed {
+		t.Error("pausing past the cleanup interval reset the limit")
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	g := &APIGateway{limiter: &memoryRateLimiter{buckets: map[string]*bucket{}}}
+	limit := RateLimit{Requests: 2, Per: time.Minute}
+
+	r := gin.New()
+	r.GET("/", func(c *gin.Context) {
+		if g.rateLimitIP(c, "test", limit) {
+			c.Status(http.StatusOK)
+		}
+	})
+
+	var last *httptest.ResponseRecorder
+	for i := 0; i < 3; i++ {
+		last = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		r.ServeHTTP(last, req)
+	}
+
+	if last.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", last.Code)
+	}
+	if got := last.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After = %q, want 30", got)
+	}
+	if got := last.Header().Get("X-RateLimit-Limit"); got != "2" {
+		t.Errorf("X-RateLimit-Limit = %q, want 2", got)
+	}
+}
+
+// Requests with bad credentials count against the client IP, so they cannot
+// be used to guess tokens or API keys without limit.
+func TestRateLimitBeforeAuthentication(t *testing.T) {
+	g := &APIGateway{limiter: &memoryRateLimiter{buckets: map[string]*bucket{}}}
+	limit := RateLimit{Requests: 2, Per: time.Minute}
+	route := RouteConfig{Method: http.MethodGet, Path: "/api/tasks", Auth: true, RateLimit: "test", limit: &limit}
+
+	r := gin.New()
+	r.GET("/api/tasks", g.proxyRequest(route, nil))
+
+	for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		req := httptest.NewRequest(http.MethodGet, "/api/tasks", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Authorization", "Bearer not-a-token")
+		if w := doRequest(r, req); w.Code != want {
+			t.Errorf("request %d: status = %d, want %d", i+1, w.Code, want)
+		}
+	}
+}
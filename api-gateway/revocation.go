@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const revocationsPath = "/internal/revocations"
+
+// Revocations take effect at the gateway within revocationPollInterval.
+// Each poll overlaps the previous one by revocationOverlap so rows written
+// in the same second as a snapshot are not missed.
+const (
+	revocationPollInterval = 10 * time.Second
+	revocationOverlap      = 5 * time.Second
+)
+
+// maxTokenLifetime is the longest access token lifetime user-service issues.
+// Tokens claiming a longer one are rejected, so a revoke-all older than this
+// no longer matches any valid token.
+const maxTokenLifetime = 15 * time.Minute
+
+// revocationCache mirrors the revocation list kept by user-service.
+type revocationCache struct {
+	mu       sync.RWMutex
+	tokens   map[string]time.Time // jti -> token expiry
+	sessions map[int64]time.Time  // user ID -> tokens issued at or before are revoked
+	asOf     int64                // as_of of the last successful sync
+}
+
+// tokenRevoked reports whether a token was revoked individually or by a
+// revoke-all for its user.
+func (g *APIGateway) tokenRevoked(jti string, userID int64, issuedAt time.Time) bool {
+	rc := &g.revocations
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+
+	if _, ok := rc.tokens[jti]; ok {
+		return true
+	}
+	// Both are whole seconds, so a token issued in the second of the revoke
+	// may predate it
+	if revokedAt, ok := rc.sessions[userID]; ok && !issuedAt.After(revokedAt) {
+		return true
+	}
+	return false
+}
+
+// syncRevocations fetches revocations made since the last sync and drops
+// entries for tokens that have expired.
+func (g *APIGateway) syncRevocations(ctx context.Context) error {
+	g.mu.RLock()
+	u := g.services[identityService]
+	g.mu.RUnlock()
+	if u == nil {
+		return fmt.Errorf("service %q is not configured", identityService)
+	}
+
+	rc := &g.revocations
+	rc.mu.RLock()
+	since := rc.asOf
+	rc.mu.RUnlock()
+	if since > 0 {
+		since -= int64(revocationOverlap / time.Second)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		"http://"+u.name+revocationsPath+"?since="+strconv.FormatInt(since, 10), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := u.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var feed struct {
+		Tokens []struct {
+			JTI       string `json:"jti"`
+			ExpiresAt int64  `json:"expires_at"`
+		} `json:"revoked_tokens"`
+		Sessions []struct {
+			UserID    int64 `json:"user_id"`
+			RevokedAt int64 `json:"revoked_at"`
+		} `json:"revoked_sessions"`
+		AsOf int64 `json:"as_of"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(&feed); err != nil {
+		return err
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.tokens == nil {
+		rc.tokens = map[string]time.Time{}
+		rc.sessions = map[int64]time.Time{}
+	}
+	for _, t := range feed.Tokens {
+		rc.tokens[t.JTI] = time.Unix(t.ExpiresAt, 0)
+	}
+	for _, s := range feed.Sessions {
+		revokedAt := time.Unix(s.RevokedAt, 0)
+		if revokedAt.After(rc.sessions[s.UserID]) {
+			rc.sessions[s.UserID] = revokedAt
+		}
+	}
+
+	now := time.Now()
+	for jti, expires := range rc.tokens {
+		if now.After(expires) {
+			delete(rc.tokens, jti)
+		}
+	}
+	for userID, revokedAt := range rc.sessions {
+		if now.Sub(revokedAt) > maxTokenLifetime {
+			delete(rc.sessions, userID)
+		}
+	}
+	rc.asOf = feed.AsOf
+	return nil
+}
+
+// watchRevocations polls user-service for new revocations. If it cannot be
+// reached the cached list stays in force.
+func (g *APIGateway) watchRevocations(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := g.syncRevocations(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("revocation sync failed, keeping cached list", "error", err)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenRevoked(t *testing.T) {
+	revokedAt := time.Unix(1700000000, 0)
+	g := &APIGateway{}
+	g.revocations.tokens = map[string]time.Time{"revoked": revokedAt.Add(time.Minute)}
+	g.revocations.sessions = map[int64]time.Time{7: revokedAt}
+
+	tests := []struct {
+		name     string
+		jti      string
+		userID   int64
+		issuedAt time.Time
+		want     bool
+	}{
+		{"revoked token", "revoked", 8, revokedAt, true},
+		{"issued before revoke-all", "a", 7, revokedAt.Add(-time.Second), true},
+		// It may have been issued just before the revoke
+		{"issued in the second of revoke-all", "a", 7, revokedAt, true},
+		{"issued after revoke-all", "a", 7, revokedAt.Add(time.Second), false},
+		{"other user", "a", 8, revokedAt.Add(-time.Second), false},
+	}
+	for _, tt := range tests {
+		if got := g.tokenRevoked(tt.jti, tt.userID, tt.issuedAt); got != tt.want {
+			t.Errorf("%s: tokenRevoked = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
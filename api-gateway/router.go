@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ServeHTTP dispatches to the router built from the most recently loaded
+// configuration. Requests already in flight keep the router they started on.
+func (g *APIGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.RLock()
+	router := g.router
+	g.mu.RUnlock()
+
+	router.ServeHTTP(w, r)
+}
+
+// Reload loads the configuration file and atomically swaps in the new
+// services and routes. On error the current configuration stays active.
+// Services whose settings did not change keep their upstream, so open
+// breakers and instances out of rotation stay that way.
+func (g *APIGateway) Reload() error {
+	cfg, err := loadConfig(g.configPath)
+	if err != nil {
+		return err
+	}
+
+	g.mu.RLock()
+	previous := g.services
+	g.mu.RUnlock()
+
+	services := make(map[string]*upstream, len(cfg.Services))
+	for name, svc := range cfg.Services {
+		if u, ok := previous[name]; ok && reflect.DeepEqual(u.config, svc) {
+			services[name] = u
+			continue
+		}
+		u, err := newUpstream(svc, g.signer, g.cache)
+		if err != nil {
+			return fmt.Errorf("service %q: %w", name, err)
+		}
+		services[name] = u
+	}
+
+	router, err := g.buildRouter(cfg, services)
+	if err != nil {
+		return err
+	}
+
+	for name, u := range services {
+		if previous[name] != u {
+			u.startHealthChecks()
+		}
+	}
+
+	g.mu.Lock()
+	g.config = cfg
+	g.services = services
+	g.router = router
+	g.mu.Unlock()
+
+	g.openAPI.invalidate()
+
+	for name, u := range previous {
+		if services[name] != u {
+			u.stopHealthChecks()
+		}
+	}
+
+	log.Printf("Loaded %d routes for %d services from %s", len(cfg.Routes), len(cfg.Services), g.configPath)
+	return nil
+}
+
+// Close stops the health checks of the current upstreams.
+func (g *APIGateway) Close() {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	for _, u := range g.services {
+		u.stopHealthChecks()
+	}
+}
+
+// buildRouter registers the configured routes on a fresh gin engine.
+// gin panics on conflicting routes, which is reported as an error instead.
+func (g *APIGateway) buildRouter(cfg *GatewayConfig, services map[string]*upstream) (router *gin.Engine, err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("register routes: %v", rec)
+		}
+	}()
+
+	r := gin.New()
+	r.Use(gin.Recovery(), requestID(), accessLog(), metrics())
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("trusted_proxies: %w", err)
+	}
+
+	r.Use(cors(cfg.CORS))
+
+	for _, route := range cfg.endpoints {
+		r.Handle(route.Method, route.Path, g.proxyRequest(route, services[route.Service]))
+	}
+
+	// Health and circuit breaker state per upstream instance
+	r.GET("/admin/upstreams", g.requireRoles(roleAdmin), func(c *gin.Context) {
+		states := make(map[string]gin.H, len(services))
+		for name, u := range services {
+			states[name] = gin.H{
+				"balancer":  u.balancer,
+				"instances": u.snapshot(),
+			}
+		}
+		c.JSON(http.StatusOK, states)
+	})
+
+	if cfg.GraphQL.Enabled {
+		if _, err := graphqlSchema(); err != nil {
+			return nil, fmt.Errorf("graphql schema: %w", err)
+		}
+		r.POST("/graphql", g.serveGraphQL(cfg.GraphQL, services))
+	}
+
+	if cfg.Batch.Enabled {
+		r.POST(batchPath, g.serveBatch(cfg.Batch, r))
+	}
+
+	// Merged API specification and interactive docs
+	r.GET("/openapi.json", g.serveOpenAPI)
+	r.GET("/docs", serveDocs)
+
+	r.GET("/routes", func(c *gin.Context) {
+		routes := []string{}
+		for _, ri := range r.Routes() {
+			routes = append(routes, ri.Method+" "+ri.Path)
+		}
+		c.JSON(http.StatusOK, routes)
+	})
+
+	return r, nil
+}
+
+// watchConfig reloads the configuration on SIGHUP or when the file changes.
+func (g *APIGateway) watchConfig(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastMod := configModTime(g.configPath)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Printf("Received SIGHUP, reloading %s", g.configPath)
+		case <-ticker.C:
+			mod := configModTime(g.configPath)
+			if mod.IsZero() || mod.Equal(lastMod) {
+				continue
+			}
+			lastMod = mod
+			log.Printf("Detected change in %s, reloading", g.configPath)
+		}
+
+		if err := g.Reload(); err != nil {
+			log.Printf("Config reload failed, keeping previous configuration: %v", err)
+		}
+	}
+}
+
+func configModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// rewritePath fills route parameters into a rewrite template.
+func rewritePath(template string, params gin.Params) string {
+	segments := strings.Split(template, "/")
+	for i, seg := range segments {
+		if strings.HasPrefix(seg, ":") || strings.HasPrefix(seg, "*") {
+			segments[i] = strings.TrimPrefix(params.ByName(seg[1:]), "/")
+		}
+	}
+	return strings.Join(segments, "/")
+}
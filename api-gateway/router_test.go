@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const reloadTestConfig = `
+services:
+  tasks:
+    url: http://localhost:1
+    health_check: { disabled: true }
+  notifications:
+    url: http://localhost:2
+    health_check: { disabled: true }%s
+routes:
+  - { method: GET, path: /api/tasks, service: tasks }
+  - { method: GET, path: /api/notifications, service: notifications }
+`
+
+// Reloading keeps the state of services whose settings did not change, so
+// an instance taken out of rotation is not sent traffic again.
+func TestReloadKeepsUpstreamState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	write := func(extra string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(fmt.Sprintf(reloadTestConfig, extra)), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	signer, err := newInternalSigner(strings.Repeat("s", minInternalSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewAPIGateway(path, signer, newMemoryRateLimiter(), newMemoryIdempotencyStore(), newTestCache(t))
+	t.Cleanup(func() {
+		g.Close()
+		g.limiter.Close()
+		g.idempotency.Close()
+	})
+
+	write("")
+	if err := g.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	tasks, notifications := g.services["tasks"], g.services["notifications"]
+	tasks.backends[0].healthy.Store(false)
+	notifications.backends[0].healthy.Store(false)
+
+	// Only notifications changes
+	write("\n    timeouts: { response: 3s }")
+	if err := g.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if g.services["tasks"] != tasks {
+		t.Error("unchanged service got a new upstream")
+	}
+	if g.services["tasks"].backends[0].healthy.Load() {
+		t.Error("unchanged service's instance returned to rotation")
+	}
+	if g.services["notifications"] == notifications {
+		t.Error("changed service kept its upstream")
+	}
+}
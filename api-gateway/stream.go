@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultStreamIdleTimeout applies to stream routes without idle_timeout.
+const defaultStreamIdleTimeout = time.Minute
+
+// queryAccessToken carries the bearer token on stream routes. Browser
+// EventSource and WebSocket clients cannot set an Authorization header.
+const queryAccessToken = "access_token"
+
+// isUpgrade reports whether r asks to switch protocols, as for WebSocket.
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range strings.Split(r.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenFromQuery moves an access_token query parameter into the
+// Authorization header so it is verified like any bearer token and never
+// reaches the upstream or its logs.
+func tokenFromQuery(r *http.Request) {
+	q := r.URL.Query()
+	token := q.Get(queryAccessToken)
+	if token == "" {
+		return
+	}
+	q.Del(queryAccessToken)
+	r.URL.RawQuery = q.Encode()
+	r.RequestURI = r.URL.RequestURI()
+	if r.Header.Get("Authorization") == "" && r.Header.Get(headerAPIKey) == "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+type streamKey struct{}
+
+// openStream lifts the server's read and write deadlines for a long-lived
+// connection. The returned context is cancelled once no data has passed in
+// either direction for idle, or when the gateway shuts down; cancelling it
+// closes the upstream connection. done must be called when the request ends.
+func (g *APIGateway) openStream(c *gin.Context, idle time.Duration) (ctx context.Context, done func()) {
+	rc := http.NewResponseController(c.Writer)
+	if err := rc.SetReadDeadline(time.Time{}); err != nil {
+		slog.Warn("cannot clear read deadline for stream", "request_id", c.GetString(ctxRequestID), "error", err)
+	}
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		slog.Warn("cannot clear write deadline for stream", "request_id", c.GetString(ctxRequestID), "error", err)
+	}
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	stopOnShutdown := context.AfterFunc(g.streams, cancel)
+	t := newIdleTimer(idle, cancel)
+
+	return context.WithValue(ctx, streamKey{}, t), func() {
+		t.stop()
+		stopOnShutdown()
+		cancel()
+	}
+}
+
+// recoverClosedStream ends the response quietly when the proxy aborts because
+// the stream context was cancelled, as on idle timeout or shutdown. It must
+// be deferred directly.
+func recoverClosedStream(ctx context.Context) {
+	if rec := recover(); rec != nil {
+		if rec == http.ErrAbortHandler && ctx.Err() != nil {
+			return
+		}
+		panic(rec)
+	}
+}
+
+// idleTimer calls onIdle once touch has not been called for timeout.
+type idleTimer struct {
+	timeout time.Duration
+	last    atomic.Int64 // UnixNano of the last activity
+	timer   *time.Timer
+}
+
+func newIdleTimer(timeout time.Duration, onIdle func()) *idleTimer {
+	t := &idleTimer{timeout: timeout}
+	t.touch()
+	t.timer = time.AfterFunc(timeout, func() {
+		if quiet := time.Since(time.Unix(0, t.last.Load())); quiet < t.timeout {
+			t.timer.Reset(t.timeout - quiet)
+			return
+		}
+		onIdle()
+	})
+	return t
+}
+
+func (t *idleTimer) touch() {
+	t.last.Store(time.Now().UnixNano())
+}
+
+func (t *idleTimer) stop() {
+	t.timer.Stop()
+}
+
+// trackIdle wraps the body of a stream response so traffic keeps the idle
+// timer from firing. After a protocol switch the body is the upstream
+// connection itself, so both directions pass through it.
+func trackIdle(req *http.Request, resp *http.Response) {
+	t, ok := req.Context().Value(streamKey{}).(*idleTimer)
+	if !ok {
+		return
+	}
+	if rwc, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = &idleConn{idleBody{rwc, t}, rwc}
+		return
+	}
+	resp.Body = &idleBody{resp.Body, t}
+}
+
+type idleBody struct {
+	io.ReadCloser
+	t *idleTimer
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.t.touch()
+	}
+	return n, err
+}
+
+type idleConn struct {
+	idleBody
+	w io.Writer
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	c.t.touch()
+	return c.w.Write(p)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxTransformBody is the largest response body a transform rewrites. Larger
+// responses fail rather than pass through with fields the route hides.
+const maxTransformBody = 10 << 20
+
+// maskedValue replaces masked JSON fields.
+const maskedValue = "****"
+
+// TransformConfig rewrites requests and responses of the routes that name it.
+// Path rewrites are the route's rewrite setting.
+type TransformConfig struct {
+	RequestHeaders  HeaderTransform `yaml:"request_headers"`
+	ResponseHeaders HeaderTransform `yaml:"response_headers"`
+	ResponseBody    BodyTransform   `yaml:"response_body"`
+}
+
+// HeaderTransform is applied as rename, then remove, then add.
+type HeaderTransform struct {
+	Rename map[string]string `yaml:"rename"`
+	Remove []string          `yaml:"remove"`
+	Add    map[string]string `yaml:"add"`
+}
+
+// BodyTransform edits JSON response bodies. Fields are dot-separated paths
+// such as owner.email; a path crossing an array applies to every element.
+// It is applied as remove, then mask, then rename.
+type BodyTransform struct {
+	Remove []string `yaml:"remove"`
+	Mask   []string `yaml:"mask"`
+	// Rename maps a field path to its new name in the same object.
+	Rename map[string]string `yaml:"rename"`
+}
+
+func (b BodyTransform) empty() bool {
+	return len(b.Remove) == 0 && len(b.Mask) == 0 && len(b.Rename) == 0
+}
+
+// Headers a transform may not set on requests; they carry identity the
+// gateway vouches for.
+var protectedRequestHeaders = append([]string{headerInternalToken}, identityHeaders...)
+
+func (t TransformConfig) validate(name string) []error {
+	var errs []error
+	prefix := fmt.Sprintf("transform %q", name)
+
+	for _, h := range []struct {
+		name string
+		t    HeaderTransform
+	}{{"request_headers", t.RequestHeaders}, {"response_headers", t.ResponseHeaders}} {
+		var set []string
+		for from, to := range h.t.Rename {
+			if from == "" || to == "" {
+				errs = append(errs, fmt.Errorf("%s: %s: empty header name in rename", prefix, h.name))
+			}
+			set = append(set, to)
+		}
+		for _, header := range h.t.Remove {
+			if header == "" {
+				errs = append(errs, fmt.Errorf("%s: %s: empty header name in remove", prefix, h.name))
+			}
+		}
+		for header := range h.t.Add {
+			if header == "" {
+				errs = append(errs, fmt.Errorf("%s: %s: empty header name in add", prefix, h.name))
+			}
+			set = append(set, header)
+		}
+		if h.name != "request_headers" {
+			continue
+		}
+		for _, header := range set {
+			for _, protected := range protectedRequestHeaders {
+				if strings.EqualFold(header, protected) {
+					errs = append(errs, fmt.Errorf("%s: %s: cannot set %s", prefix, h.name, protected))
+				}
+			}
+		}
+	}
+
+	body := t.ResponseBody
+	for _, path := range append(append([]string{}, body.Remove...), body.Mask...) {
+		if !validFieldPath(path) {
+			errs = append(errs, fmt.Errorf("%s: response_body: invalid field path %q", prefix, path))
+		}
+	}
+	for from, to := range body.Rename {
+		if !validFieldPath(from) || to == "" || strings.Contains(to, ".") {
+			errs = append(errs, fmt.Errorf("%s: response_body: invalid rename %q to %q", prefix, from, to))
+		}
+	}
+	return errs
+}
+
+func validFieldPath(path string) bool {
+	for _, key := range strings.Split(path, ".") {
+		if key == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// applyRequest transforms the headers of a request to be proxied and
+// returns it marked for transformResponse. A body transform also asks for an
+// uncompressed response so it can be edited.
+func (t *TransformConfig) applyRequest(r *http.Request) *http.Request {
+	t.RequestHeaders.apply(r.Header)
+	if !t.ResponseBody.empty() {
+		r.Header.Del("Accept-Encoding")
+	}
+	return r.WithContext(context.WithValue(r.Context(), transformKey{}, t))
+}
+
+func (h HeaderTransform) apply(header http.Header) {
+	for from, to := range h.Rename {
+		if values := header.Values(from); len(values) > 0 {
+			header.Del(from)
+			header[http.CanonicalHeaderKey(to)] = values
+		}
+	}
+	for _, name := range h.Remove {
+		header.Del(name)
+	}
+	for name, value := range h.Add {
+		header.Set(name, value)
+	}
+}
+
+type transformKey struct{}
+
+// transformResponse applies the transform of the route that sent the
+// request. It is the upstream proxy's ModifyResponse.
+func transformResponse(resp *http.Response) error {
+	t, ok := resp.Request.Context().Value(transformKey{}).(*TransformConfig)
+	if !ok {
+		return nil
+	}
+	t.ResponseHeaders.apply(resp.Header)
+	if t.ResponseBody.empty() {
+		return nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return nil
+	}
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return fmt.Errorf("cannot transform %s encoded response", enc)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxTransformBody+1))
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if len(data) > maxTransformBody {
+		return fmt.Errorf("response body exceeds %d bytes", maxTransformBody)
+	}
+
+	if len(bytes.TrimSpace(data)) > 0 {
+		var doc any
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return fmt.Errorf("decode response body: %w", err)
+		}
+		t.ResponseBody.apply(doc)
+		if data, err = json.Marshal(doc); err != nil {
+			return err
+		}
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = int64(len(data))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	// The upstream's validator no longer describes this body
+	resp.Header.Del("ETag")
+	return nil
+}
+
+func (b BodyTransform) apply(doc any) {
+	for _, path := range b.Remove {
+		editField(doc, strings.Split(path, "."), func(obj map[string]any, key string) {
+			delete(obj, key)
+		})
+	}
+	for _, path := range b.Mask {
+		editField(doc, strings.Split(path, "."), func(obj map[string]any, key string) {
+			if obj[key] != nil {
+				obj[key] = maskedValue
+			}
+		})
+	}
+	for from, to := range b.Rename {
+		editField(doc, strings.Split(from, "."), func(obj map[string]any, key string) {
+			obj[to] = obj[key]
+			delete(obj, key)
+		})
+	}
+}
+
+// editField calls edit for each object holding the last key of path.
+func editField(v any, path []string, edit func(obj map[string]any, key string)) {
+	switch v := v.(type) {
+	case []any:
+		for _, item := range v {
+			editField(item, path, edit)
+		}
+	case map[string]any:
+		if len(path) == 1 {
+			if _, ok := v[path[0]]; ok {
+				edit(v, path[0])
+			}
+			return
+		}
+		editField(v[path[0]], path[1:], edit)
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errCircuitOpen      = errors.New("circuit breaker open")
+	errNoHealthyBackend = errors.New("no healthy backend")
+)
+
+// maxRetryBody is the largest request body buffered so it can be replayed
+// on retry. Larger bodies are streamed and never retried.
+const maxRetryBody = 1 << 20
+
+// idempotentMethods may be retried safely after an upstream failure.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// upstream is a proxied service backed by one or more instances. Each
+// request attempt is sent to an instance chosen by the balancer; retries
+// prefer instances that have not failed yet.
+type upstream struct {
+	name      string
+	config    ServiceConfig // as loaded, to detect changes on reload
+	backends  []*backend
+	balancer  string
+	retries   RetryConfig
+	breaker   BreakerConfig
+	health    HealthCheckConfig
+	transport http.RoundTripper
+	proxy     *httputil.ReverseProxy
+	signer    *internalSigner
+	cache     *responseCache
+
+	next atomic.Uint64 // round-robin cursor
+	stop context.CancelFunc
+}
+
+// backend is a single instance of an upstream service.
+type backend struct {
+	url     *url.URL
+	breaker *circuitBreaker
+	healthy atomic.Bool
+	active  atomic.Int64 // in-flight requests
+
+	// Consecutive probe results, owned by the health check goroutine
+	passes, fails int
+}
+
+func newUpstream(cfg ServiceConfig, signer *internalSigner, cache *responseCache) (*upstream, error) {
+	u := &upstream{
+		name:     cfg.Name,
+		config:   cfg,
+		balancer: cfg.Balancer,
+		retries:  cfg.Retries,
+		breaker:  cfg.Breaker,
+		health:   cfg.HealthCheck,
+		signer:   signer,
+		cache:    cache,
+		stop:     func() {},
+	}
+
+	for _, raw := range cfg.URLs {
+		target, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		b := &backend{
+			url:     target,
+			breaker: newCircuitBreaker(cfg.Name+" "+target.Host, cfg.Breaker),
+		}
+		// Instances start in rotation until a probe says otherwise
+		b.healthy.Store(true)
+		u.backends = append(u.backends, b)
+	}
+
+	dialer := &net.Dialer{Timeout: cfg.Timeouts.Dial, KeepAlive: 30 * time.Second}
+	u.transport = &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ResponseHeaderTimeout: cfg.Timeouts.Response,
+		MaxIdleConnsPerHost:   32,
+		IdleConnTimeout:       90 * time.Second,
+	}
+
+	// The director only prepares the outgoing request; RoundTrip picks the
+	// instance for each attempt and prefixes its base path.
+	u.proxy = &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = u.backends[0].url.Scheme
+			req.URL.Host = u.backends[0].url.Host
+			if _, ok := req.Header["User-Agent"]; !ok {
+				// Explicitly disable the default Go User-Agent
+				req.Header.Set("User-Agent", "")
+			}
+		},
+		Transport:      u,
+		ModifyResponse: u.modifyResponse,
+		ErrorHandler:   u.handleError,
+	}
+
+	return u, nil
+}
+
+// modifyResponse applies cache invalidations, the route's transform and
+// caching to an upstream response before it is written.
+func (u *upstream) modifyResponse(resp *http.Response) error {
+	u.invalidateCache(resp)
+	if err := transformResponse(resp); err != nil {
+		return err
+	}
+	return u.cacheResponse(resp)
+}
+
+// handleError reports upstream failures without leaking internal details.
+func (u *upstream) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	markProxyFailure(r, err)
+
+	status := http.StatusBadGateway
+	message := "Upstream service unavailable"
+
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		status = http.StatusServiceUnavailable
+		message = "Service temporarily unavailable"
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(u.breaker.OpenTimeout)))
+	case errors.Is(err, errNoHealthyBackend):
+		status = http.StatusServiceUnavailable
+		message = "Service temporarily unavailable"
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(u.health.Interval)))
+	case errors.Is(err, context.Canceled):
+		// Client went away; nobody is left to read the response
+		return
+	case isTimeout(err):
+		status = http.StatusGatewayTimeout
+		message = "Upstream service timed out"
+	}
+
+	slog.Error("proxy error",
+		"request_id", r.Header.Get(headerRequestID),
+		"service", u.name,
+		"method", r.Method,
+		"path", r.URL.Path,
+		"error", err)
+	writeJSONError(w, status, message)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	body, _ := json.Marshal(map[string]string{"error": message})
+	w.Write(body)
+}
+
+// RoundTrip sends the request to a healthy instance, retrying idempotent
+// requests on connection errors and 502/503/504 responses with jittered
+// exponential backoff. Outcomes are reported to each instance's breaker.
+// Every request, proxied or the gateway's own, carries an internal token.
+func (u *upstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempts := 1
+	body, replayable := bufferBody(req)
+	if idempotentMethods[req.Method] && replayable {
+		attempts = u.retries.Attempts
+	}
+
+	tried := map[*backend]bool{}
+	for attempt := 1; ; attempt++ {
+		b, err := u.pick(tried)
+		if err != nil {
+			return nil, err
+		}
+		tried[b] = true
+
+		attemptReq := req.Clone(req.Context())
+		attemptReq.URL.Scheme = b.url.Scheme
+		attemptReq.URL.Host = b.url.Host
+		attemptReq.URL.Path, attemptReq.URL.RawPath = joinURLPath(b.url, req.URL)
+		attemptReq.Host = ""
+		if body != nil {
+			attemptReq.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		if err := u.signer.sign(attemptReq); err != nil {
+			b.breaker.release()
+			return nil, err
+		}
+
+		b.active.Add(1)
+		resp, err := u.transport.RoundTrip(attemptReq)
+		b.active.Add(-1)
+
+		if err != nil && errors.Is(err, context.Canceled) {
+			// Caller cancelled; not the instance's fault
+			b.breaker.release()
+			return nil, err
+		}
+
+		failed := err != nil || isRetryableStatus(resp.StatusCode)
+		b.breaker.record(!failed)
+		if !failed || attempt >= attempts {
+			if err == nil {
+				trackIdle(req, resp)
+			}
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(u.retries.backoff(attempt)):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// joinURLPath appends the request path to the instance's base path, so an
+// instance at http://host/tasks receives /api/tasks as /tasks/api/tasks. The
+// escaped form is kept when either side has one.
+func joinURLPath(base, req *url.URL) (path, rawPath string) {
+	if base.Path == "" && base.RawPath == "" {
+		return req.Path, req.RawPath
+	}
+	if base.RawPath == "" && req.RawPath == "" {
+		return singleJoiningSlash(base.Path, req.Path), ""
+	}
+	rawPath = singleJoiningSlash(base.EscapedPath(), req.EscapedPath())
+	return singleJoiningSlash(base.Path, req.Path), rawPath
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// pick returns the next instance according to the balancing strategy,
+// skipping unhealthy instances and those whose breaker is open. Instances in
+// tried are only reused once every other option is exhausted.
+func (u *upstream) pick(tried map[*backend]bool) (*backend, error) {
+	candidates := u.order()
+
+	sawHealthy := false
+	for _, skipTried := range []bool{true, false} {
+		for _, b := range candidates {
+			if !b.healthy.Load() || (skipTried && tried[b]) {
+				continue
+			}
+			sawHealthy = true
+			if b.breaker.allow() {
+				return b, nil
+			}
+		}
+	}
+
+	if sawHealthy {
+		return nil, errCircuitOpen
+	}
+	return nil, errNoHealthyBackend
+}
+
+// order lists instances in preference order for the next attempt.
+func (u *upstream) order() []*backend {
+	n := len(u.backends)
+	start := int(u.next.Add(1) % uint64(n))
+
+	ordered := make([]*backend, 0, n)
+	for i := 0; i < n; i++ {
+		ordered = append(ordered, u.backends[(start+i)%n])
+	}
+
+	if u.balancer == balancerLeastConnections {
+		// Insertion sort is stable, so round-robin order breaks ties
+		for i := 1; i < n; i++ {
+			for j := i; j > 0 && ordered[j].active.Load() < ordered[j-1].active.Load(); j-- {
+				ordered[j], ordered[j-1] = ordered[j-1], ordered[j]
+			}
+		}
+	}
+	return ordered
+}
+
+func isRetryableStatus(status int) bool {
+	return status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable ||
+		status == http.StatusGatewayTimeout
+}
+
+// bufferBody reads a small request body into memory so it can be replayed.
+// It reports false when the body is too large, in which case req.Body is
+// left streaming.
+func bufferBody(req *http.Request) ([]byte, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxRetryBody+1))
+	if err != nil || len(body) > maxRetryBody {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil, false
+	}
+	req.Body.Close()
+	return body, true
+}
+
+// backoff returns a full-jitter delay for the given attempt.
+func (r RetryConfig) backoff(attempt int) time.Duration {
+	delay := r.Backoff << (attempt - 1)
+	if delay <= 0 || delay > r.MaxBackoff {
+		delay = r.MaxBackoff
+	}
+	return rand.N(delay) + 1
+}
+
+type backendSnapshot struct {
+	URL     string          `json:"url"`
+	Healthy bool            `json:"healthy"`
+	Active  int64           `json:"active_requests"`
+	Breaker breakerSnapshot `json:"breaker"`
+}
+
+func (u *upstream) snapshot() []backendSnapshot {
+	out := make([]backendSnapshot, 0, len(u.backends))
+	for _, b := range u.backends {
+		out = append(out, backendSnapshot{
+			URL:     b.url.String(),
+			Healthy: b.healthy.Load(),
+			Active:  b.active.Load(),
+			Breaker: b.breaker.snapshot(),
+		})
+	}
+	return out
+}
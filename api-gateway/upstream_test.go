@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestJoinURLPath(t *testing.T) {
+	tests := []struct {
+		base, req         string
+		wantPath, wantRaw string
+	}{
+		{"http://host", "/api/tasks", "/api/tasks", ""},
+		{"http://host/", "/api/tasks", "/api/tasks", ""},
+		{"http://host/tasks", "/api/tasks", "/tasks/api/tasks", ""},
+		{"http://host/tasks/", "/api/tasks", "/tasks/api/tasks", ""},
+		{"http://host/tasks", "/api/tasks/a%2Fb", "/tasks/api/tasks/a/b", "/tasks/api/tasks/a%2Fb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.base+tt.req, func(t *testing.T) {
+			base, _ := url.Parse(tt.base)
+			req, _ := url.Parse(tt.req)
+			path, raw := joinURLPath(base, req)
+			if path != tt.wantPath || raw != tt.wantRaw {
+				t.Errorf("joinURLPath = %q, %q, want %q, %q", path, raw, tt.wantPath, tt.wantRaw)
+			}
+		})
+	}
+}
+
+// Instances behind a path prefix receive requests under that prefix, signed
+// for the path they actually see.
+func TestUpstreamBasePath(t *testing.T) {
+	var gotPath, gotToken string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.EscapedPath()
+		gotToken = r.Header.Get(headerInternalToken)
+	}))
+	t.Cleanup(srv.Close)
+
+	signer, err := newInternalSigner(strings.Repeat("s", minInternalSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := newUpstream(ServiceConfig{Name: "test", BaseURL: srv.URL + "/tasks"}.withDefaults(), signer, newTestCache(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := doRequest(u.proxy, httptest.NewRequest(http.MethodGet, "/api/tasks/1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	if gotPath != "/tasks/api/tasks/1" {
+		t.Errorf("upstream path = %q, want /tasks/api/tasks/1", gotPath)
+	}
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(gotToken, claims); err != nil {
+		t.Fatalf("internal token: %v", err)
+	}
+	if claims["path"] != gotPath {
+		t.Errorf("token signed for %v, want %s", claims["path"], gotPath)
+	}
+}
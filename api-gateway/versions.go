@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiPrefix marks the routes that are versioned. A route for /api/tasks in
+// version v2 is served at /api/v2/tasks; the default version is also served
+// at the unversioned path. The upstream receives the unversioned path unless
+// the route sets a rewrite.
+const apiPrefix = "/api/"
+
+var versionName = regexp.MustCompile(`^v[0-9]+$`)
+
+// VersionConfig describes one API version.
+type VersionConfig struct {
+	// Inherit names a version whose routes are also served under this one
+	// unless it defines the same method and path itself.
+	Inherit string `yaml:"inherit"`
+	// DeprecatedAt and SunsetAt are announced in the Deprecation and Sunset
+	// response headers. Once SunsetAt has passed the version answers 410.
+	DeprecatedAt time.Time `yaml:"deprecated_at"`
+	SunsetAt     time.Time `yaml:"sunset_at"`
+	// Link points clients at migration notes.
+	Link string `yaml:"link"`
+}
+
+func (v VersionConfig) retiring() bool {
+	return !v.DeprecatedAt.IsZero() || !v.SunsetAt.IsZero()
+}
+
+// writeHeaders announces deprecation (RFC 9745) and sunset (RFC 8594).
+func (v VersionConfig) writeHeaders(h http.Header) {
+	if !v.DeprecatedAt.IsZero() {
+		h.Set("Deprecation", "@"+strconv.FormatInt(v.DeprecatedAt.Unix(), 10))
+	}
+	if !v.SunsetAt.IsZero() {
+		h.Set("Sunset", v.SunsetAt.UTC().Format(http.TimeFormat))
+	}
+	if v.Link != "" {
+		rel := "deprecation"
+		if v.DeprecatedAt.IsZero() {
+			rel = "sunset"
+		}
+		h.Add("Link", "<"+v.Link+`>; rel="`+rel+`"; type="text/html"`)
+	}
+}
+
+// versionOf returns the version a configured route belongs to.
+func (cfg *GatewayConfig) versionOf(route RouteConfig) string {
+	if route.Version != "" {
+		return route.Version
+	}
+	return cfg.DefaultVersion
+}
+
+func (cfg *GatewayConfig) validateVersions() []error {
+	var errs []error
+	if len(cfg.Versions) == 0 {
+		if cfg.DefaultVersion != "" {
+			errs = append(errs, fmt.Errorf("default_version %q: no versions defined", cfg.DefaultVersion))
+		}
+		for i, route := range cfg.Routes {
+			if route.Version != "" {
+				errs = append(errs, fmt.Errorf("route %d (%s %s): version %q: no versions defined", i, route.Method, route.Path, route.Version))
+			}
+		}
+		return errs
+	}
+
+	if _, ok := cfg.Versions[cfg.DefaultVersion]; !ok {
+		errs = append(errs, fmt.Errorf("default_version %q is not defined in versions", cfg.DefaultVersion))
+	}
+	for name, v := range cfg.Versions {
+		if !versionName.MatchString(name) {
+			errs = append(errs, fmt.Errorf("version %q: name must look like v1, v2, ...", name))
+		}
+		if v.Inherit != "" {
+			parent, ok := cfg.Versions[v.Inherit]
+			switch {
+			case !ok || v.Inherit == name:
+				errs = append(errs, fmt.Errorf("version %q: cannot inherit %q", name, v.Inherit))
+			case parent.Inherit != "":
+				errs = append(errs, fmt.Errorf("version %q: %q inherits from another version; only one level is supported", name, v.Inherit))
+			}
+		}
+		if !v.DeprecatedAt.IsZero() && !v.SunsetAt.IsZero() && v.SunsetAt.Before(v.DeprecatedAt) {
+			errs = append(errs, fmt.Errorf("version %q: sunset_at is before deprecated_at", name))
+		}
+		if v.Link != "" {
+			if u, err := url.Parse(v.Link); err != nil || !u.IsAbs() {
+				errs = append(errs, fmt.Errorf("version %q: invalid link %q", name, v.Link))
+			}
+		}
+	}
+	for i, route := range cfg.Routes {
+		prefix := fmt.Sprintf("route %d (%s %s)", i, route.Method, route.Path)
+		if route.Version == "" {
+			continue
+		}
+		if _, ok := cfg.Versions[route.Version]; !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown version %q", prefix, route.Version))
+		}
+		if !strings.HasPrefix(route.Path, apiPrefix) {
+			errs = append(errs, fmt.Errorf("%s: only %s routes are versioned", prefix, apiPrefix))
+		}
+	}
+	return errs
+}
+
+// expandVersions returns the routes to register: each /api/ route under its
+// version prefix, under the versions inheriting it, and at the unversioned
+// path for the default version. Other routes are returned unchanged.
+func (cfg *GatewayConfig) expandVersions() []RouteConfig {
+	if len(cfg.Versions) == 0 {
+		return cfg.Routes
+	}
+
+	names := make([]string, 0, len(cfg.Versions))
+	for name := range cfg.Versions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	defined := map[string]bool{}
+	for _, route := range cfg.Routes {
+		defined[cfg.versionOf(route)+" "+route.Method+" "+route.Path] = true
+	}
+
+	var routes []RouteConfig
+	for _, route := range cfg.Routes {
+		if !strings.HasPrefix(route.Path, apiPrefix) {
+			routes = append(routes, route)
+			continue
+		}
+
+		version := cfg.versionOf(route)
+		routes = append(routes, cfg.versioned(route, version))
+		if version == cfg.DefaultVersion {
+			alias := route
+			alias.Version = version
+			alias.alias = true
+			if v := cfg.Versions[version]; v.retiring() {
+				alias.lifecycle = &v
+			}
+			routes = append(routes, alias)
+		}
+		for _, name := range names {
+			if cfg.Versions[name].Inherit == version && !defined[name+" "+route.Method+" "+route.Path] {
+				routes = append(routes, cfg.versioned(route, name))
+			}
+		}
+	}
+	return routes
+}
+
+// versioned returns a copy of route served under /api/<version>/.
+func (cfg *GatewayConfig) versioned(route RouteConfig, version string) RouteConfig {
+	route.Version = version
+	route.versionPrefix = apiPrefix + version
+	route.Path = route.versionPrefix + "/" + strings.TrimPrefix(route.Path, apiPrefix)
+	if v := cfg.Versions[version]; v.retiring() {
+		route.lifecycle = &v
+	}
+	return route
+}
+
+// applyVersion adds the lifecycle headers of the route's version and strips
+// the version prefix for the upstream. It reports false once the version
+// is past its sunset.
+func applyVersion(c *gin.Context, route RouteConfig) bool {
+	if v := route.lifecycle; v != nil {
+		v.writeHeaders(c.Writer.Header())
+		if !v.SunsetAt.IsZero() && time.Now().After(v.SunsetAt) {
+			c.JSON(http.StatusGone, gin.H{"error": "API version " + route.Version + " is no longer available"})
+			return false
+		}
+	}
+	if route.versionPrefix != "" {
+		c.Request.URL.Path = "/api" + strings.TrimPrefix(c.Request.URL.Path, route.versionPrefix)
+		c.Request.URL.RawPath = ""
+	}
+	return true
+}
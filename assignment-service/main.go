@@ -2,9 +2,14 @@ package main
 
 import (
 	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -34,10 +39,25 @@ type TaskWithAssignment struct {
 var db *sql.DB
 
 func main() {
+	checkSpec := flag.Bool("check-openapi", false, "verify openapi.json against the registered routes and exit")
+	flag.Parse()
+	setupLogging()
+
+	if *checkSpec {
+		if err := checkOpenAPI(setupRouter()); err != nil {
+			log.Fatalf("openapi.json is out of sync with the routes: %v", err)
+		}
+		log.Println("openapi.json matches the registered routes")
+		return
+	}
+
 	err := godotenv.Load(".env")
 	if err != nil {
 		log.Fatalf("Error loading .env file: %v", err)
 	}
+	if err := loadInternalSecret(); err != nil {
+		log.Fatal(err)
+	}
 
 	// Database connection
 	username := os.Getenv("MYSQL_USER")
@@ -53,24 +73,66 @@ func main() {
 	}
 	defer db.Close()
 
-	r := gin.Default()
+	registerMetrics(db, "task_assignment_db")
+
+	stop, deadline := shutdownContexts()
+	go serveMetrics(stop, deadline)
+	srv := &http.Server{
+		Addr:              ":8083",
+		Handler:           setupRouter(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Println("Assignment service running on :8083")
+	if err := serve(stop, deadline, srv); err != nil {
+		log.Fatalf("Server failed: %v", err)
+	}
+	log.Println("Assignment service stopped")
+}
+
+// setupRouter registers the service routes.
+func setupRouter() *gin.Engine {
+	r := newRouter()
+	r.Use(requireInternalToken())
+
+	// Health check used by the API gateway
+	r.GET("/health", healthCheck)
+	registerOpenAPI(r)
 
 	// Task assignment routes
-	r.POST("/api/assignments/assign", assignTask)
+	r.POST("/api/assignments/assign", invalidates("assignments"), assignTask)
 	r.GET("/api/assignments/user/:user_id", getAssignedTasksForUser)
-	r.PUT("/api/assignments/:id/status", updateAssignmentStatus)
+	r.PUT("/api/assignments/:id/status", invalidates("assignments"), updateAssignmentStatus)
 	r.GET("/api/assignments", getAllAssignments)
 
-	r.Run(":8083")
+	return r
+}
+
+// healthCheck reports whether the service can reach its database.
+func healthCheck(c *gin.Context) {
+	if err := db.PingContext(c.Request.Context()); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": "database unreachable"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
 
 func assignTask(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing user identity"})
+		return
+	}
+
 	var assignment TaskAssignment
 	if err := c.BindJSON(&assignment); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	// The assigner is always the authenticated caller
+	assignment.AssignedBy = userID
+
 	// Validate task exists in task database
 	var taskExists int
 	err := db.QueryRow("SELECT COUNT(*) FROM task_db.tasks WHERE id = ?", assignment.TaskID).Scan(&taskExists)
@@ -79,13 +141,18 @@ func assignTask(c *gin.Context) {
 		return
 	}
 
-	// Validate user exists
-	var userExists int
-	err = db.QueryRow("SELECT COUNT(*) FROM user_db.users WHERE id = ?", assignment.AssignedTo).Scan(&userExists)
-	if err != nil || userExists == 0 {
+	// Validate user exists and can receive work
+	var emailVerified bool
+	err = db.QueryRow("SELECT email_verified_at IS NOT NULL FROM user_db.users WHERE id = ?", assignment.AssignedTo).
+		Scan(&emailVerified)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "User does not exist"})
 		return
 	}
+	if !emailVerified {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User has not verified their email address"})
+		return
+	}
 
 	// Insert assignment
 	result, err := db.Exec(
@@ -93,6 +160,7 @@ func assignTask(c *gin.Context) {
 		assignment.TaskID, assignment.AssignedTo, assignment.AssignedBy, time.Now(), "ASSIGNED",
 	)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Task assignment failed"})
 		return
 	}
@@ -126,6 +194,7 @@ func getAssignedTasksForUser(c *gin.Context) {
 
 	rows, err := db.Query(query, userID)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve assigned tasks"})
 		return
 	}
@@ -147,6 +216,7 @@ func getAssignedTasksForUser(c *gin.Context) {
 
 		task.AssignmentDate, _ = time.Parse("2006-01-02 15:04:05", string(assignmentDateByte))
 		if err != nil {
+			c.Error(err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan task"})
 			return
 		}
@@ -174,6 +244,7 @@ func updateAssignmentStatus(c *gin.Context) {
 		statusUpdate.Status, assignmentID,
 	)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update assignment status"})
 		return
 	}
@@ -184,6 +255,8 @@ func updateAssignmentStatus(c *gin.Context) {
 	})
 }
 
+// getAllAssignments lists every assignment, or only those for the tasks
+// named by the optional comma-separated task_ids parameter.
 func getAllAssignments(c *gin.Context) {
 	query := `
 		SELECT 
@@ -195,9 +268,22 @@ func getAllAssignments(c *gin.Context) {
 			ta.status
 		FROM task_assignments ta
 	`
+	var args []any
+	if raw, ok := c.GetQuery("task_ids"); ok {
+		ids, err := parseIDs(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		query += " WHERE ta.task_id IN (?" + strings.Repeat(", ?", len(ids)-1) + ")"
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
 
-	rows, err := db.Query(query)
+	rows, err := db.Query(query, args...)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve assignments"})
 		return
 	}
@@ -216,6 +302,7 @@ func getAllAssignments(c *gin.Context) {
 			&assignment.Status,
 		)
 		if err != nil {
+			c.Error(err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan assignment"})
 			return
 		}
@@ -225,3 +312,35 @@ func getAllAssignments(c *gin.Context) {
 
 	c.JSON(http.StatusOK, assignments)
 }
+
+// currentUserID returns the caller's ID as forwarded by the API gateway.
+func currentUserID(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.GetHeader("X-User-ID"))
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+// maxBatchIDs bounds the number of IDs accepted by batch lookups.
+const maxBatchIDs = 100
+
+// parseIDs parses a comma-separated list of positive IDs.
+func parseIDs(s string) ([]int, error) {
+	if s == "" {
+		return nil, errors.New("ids must not be empty")
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) > maxBatchIDs {
+		return nil, fmt.Errorf("at most %d ids are allowed", maxBatchIDs)
+	}
+	ids := make([]int, 0, len(parts))
+	for _, part := range parts {
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("invalid id %q", part)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
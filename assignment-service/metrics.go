@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "http_request_duration_seconds",
+	Help:    "HTTP request latency by route and status code.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"method", "route", "status"})
+
+// metrics records request latency per route template. Unmatched paths share
+// a single label so scanners cannot blow up cardinality.
+func metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequestDuration.
+			WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+// defaultMetricsAddr is where /metrics is served when METRICS_ADDR is not
+// set.
+const defaultMetricsAddr = ":9083"
+
+// serveMetrics serves /metrics on METRICS_ADDR until stop is cancelled.
+func serveMetrics(stop, deadline context.Context) {
+	addr := os.Getenv("METRICS_ADDR")
+	if addr == "" {
+		addr = defaultMetricsAddr
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	slog.Info("metrics listening", "addr", addr)
+	if err := serve(stop, deadline, srv); err != nil {
+		slog.Error("metrics server failed", "error", err)
+	}
+}
+
+// registerMetrics collects connection pool stats for db and
+// assignment counts by status.
+func registerMetrics(db *sql.DB, dbName string) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, dbName))
+	prometheus.MustRegister(statusCollector{
+		db:       db,
+		desc:     prometheus.NewDesc("task_assignments_by_status", "Number of task assignments by status.", []string{"status"}, nil),
+		query:    "SELECT status, COUNT(*) FROM task_assignments GROUP BY status",
+		statuses: []string{"ASSIGNED", "IN_PROGRESS", "COMPLETED", "CANCELLED"},
+	})
+}
+
+// statusCollector reports a gauge of row counts per status, queried at
+// scrape time.
+type statusCollector struct {
+	db       *sql.DB
+	desc     *prometheus.Desc
+	query    string
+	statuses []string
+}
+
+func (s statusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.desc
+}
+
+func (s statusCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	counts := make(map[string]int, len(s.statuses))
+	for _, status := range s.statuses {
+		counts[status] = 0
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.query)
+	if err != nil {
+		slog.Error("status metrics query failed", "error", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			slog.Error("status metrics scan failed", "error", err)
+			return
+		}
+		counts[status] = count
+	}
+
+	for status, count := range counts {
+		ch <- prometheus.MustNewConstMetric(s.desc, prometheus.GaugeValue, float64(count), status)
+	}
+}
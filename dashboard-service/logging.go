@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const headerRequestID = "X-Request-ID"
+
+const ctxRequestID = "request_id"
+
+// setupLogging routes both slog and the standard logger through a JSON
+// handler on stdout.
+func setupLogging() {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+}
+
+// newRouter returns a gin engine that logs one structured JSON line per
+// request instead of using gin's default logger.
+func newRouter() *gin.Engine {
+	r := gin.New()
+	r.Use(gin.Recovery(), requestID(), accessLog(), metrics())
+	return r
+}
+
+// requestID propagates the X-Request-ID set by the API gateway, generating
+// one for requests that bypass it.
+func requestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(headerRequestID)
+		if id == "" || len(id) > 128 {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+
+		c.Set(ctxRequestID, id)
+		c.Writer.Header().Set(headerRequestID, id)
+		c.Next()
+	}
+}
+
+// accessLog logs the request with any errors attached by handlers.
+func accessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		attrs := []any{
+			"request_id", c.GetString(ctxRequestID),
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"route", c.FullPath(),
+			"status", c.Writer.Status(),
+			"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+			"client_ip", c.ClientIP(),
+		}
+		if userID := c.GetHeader("X-User-ID"); userID != "" {
+			attrs = append(attrs, "user_id", userID)
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, "errors", c.Errors.String())
+			slog.Error("request", attrs...)
+			return
+		}
+
+		slog.Info("request", attrs...)
+	}
+}
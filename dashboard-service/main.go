@@ -2,11 +2,13 @@ package main
 
 import (
 	"database/sql"
+	"flag"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	_ "github.com/go-sql-driver/mysql"
@@ -38,10 +40,25 @@ type TaskDetail struct {
 var db *sql.DB
 
 func main() {
+	checkSpec := flag.Bool("check-openapi", false, "verify openapi.json against the registered routes and exit")
+	flag.Parse()
+	setupLogging()
+
+	if *checkSpec {
+		if err := checkOpenAPI(setupRouter()); err != nil {
+			log.Fatalf("openapi.json is out of sync with the routes: %v", err)
+		}
+		log.Println("openapi.json matches the registered routes")
+		return
+	}
+
 	err := godotenv.Load(".env")
 	if err != nil {
 		log.Fatalf("Error loading .env file: %v", err)
 	}
+	if err := loadInternalSecret(); err != nil {
+		log.Fatal(err)
+	}
 
 	// Database connection
 	username := os.Getenv("MYSQL_USER")
@@ -57,7 +74,27 @@ func main() {
 	}
 	defer db.Close()
 
-	r := gin.Default()
+	registerMetrics(db, "dashboard_db")
+
+	stop, deadline := shutdownContexts()
+	go serveMetrics(stop, deadline)
+	srv := &http.Server{
+		Addr:              ":8085",
+		Handler:           setupRouter(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Println("Dashboard service running on :8085")
+	if err := serve(stop, deadline, srv); err != nil {
+		log.Fatalf("Server failed: %v", err)
+	}
+	log.Println("Dashboard service stopped")
+}
+
+// setupRouter registers the service routes.
+func setupRouter() *gin.Engine {
+	r := newRouter()
+	r.Use(requireInternalToken())
 
 	// Static files and templates
 	r.Static("/static", "./static")
@@ -66,6 +103,10 @@ func main() {
 	})
 	r.LoadHTMLGlob("templates/*")
 
+	// Health check used by the API gateway
+	r.GET("/health", healthCheck)
+	registerOpenAPI(r)
+
 	// Web routes
 	r.GET("/dashboard/:user_id", dashboardHandler)
 	r.GET("/tasks/:user_id", tasksHandler)
@@ -74,7 +115,16 @@ func main() {
 	r.GET("/api/dashboard/:user_id", getUserDashboard)
 	r.GET("/api/dashboard/:user_id/tasks", getUserTasks)
 
-	r.Run(":8085")
+	return r
+}
+
+// healthCheck reports whether the service can reach its database.
+func healthCheck(c *gin.Context) {
+	if err := db.PingContext(c.Request.Context()); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": "database unreachable"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
 
 func getUserDashboard(c *gin.Context) {
@@ -84,6 +134,7 @@ func getUserDashboard(c *gin.Context) {
 	var username string
 	err := db.QueryRow("SELECT username FROM user_db.users WHERE id = ?", userID).Scan(&username)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
@@ -105,6 +156,7 @@ func getUserDashboard(c *gin.Context) {
 		&breakdown.Completed,
 	)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve task breakdown"})
 		return
 	}
@@ -146,6 +198,7 @@ func getUserTasks(c *gin.Context) {
 
 	rows, err := db.Query(query, args...)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve tasks" + err.Error()})
 		return
 	}
@@ -162,6 +215,7 @@ func getUserTasks(c *gin.Context) {
 			&task.AssignedDate,
 		)
 		if err != nil {
+			c.Error(err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan task"})
 			return
 		}
@@ -207,6 +261,7 @@ func dashboardHandler(c *gin.Context) {
 		&breakdown.Completed,
 	)
 	if err != nil {
+		c.Error(err)
 		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
 			"error": "Failed to retrieve dashboard data",
 		})
@@ -248,6 +303,7 @@ func tasksHandler(c *gin.Context) {
 
 	rows, err := db.Query(query, args...)
 	if err != nil {
+		c.Error(err)
 		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
 			"error": "Failed to retrieve tasks",
 		})
@@ -266,6 +322,7 @@ func tasksHandler(c *gin.Context) {
 			&task.AssignedDate,
 		)
 		if err != nil {
+			c.Error(err)
 			c.HTML(http.StatusInternalServerError, "error.html", gin.H{
 				"error": "Failed to process tasks",
 			})
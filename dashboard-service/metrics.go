@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "http_request_duration_seconds",
+	Help:    "HTTP request latency by route and status code.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"method", "route", "status"})
+
+// metrics records request latency per route template. Unmatched paths share
+// a single label so scanners cannot blow up cardinality.
+func metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequestDuration.
+			WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+// defaultMetricsAddr is where /metrics is served when METRICS_ADDR is not
+// set.
+const defaultMetricsAddr = ":9085"
+
+// serveMetrics serves /metrics on METRICS_ADDR until stop is cancelled.
+func serveMetrics(stop, deadline context.Context) {
+	addr := os.Getenv("METRICS_ADDR")
+	if addr == "" {
+		addr = defaultMetricsAddr
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	slog.Info("metrics listening", "addr", addr)
+	if err := serve(stop, deadline, srv); err != nil {
+		slog.Error("metrics server failed", "error", err)
+	}
+}
+
+// registerMetrics collects connection pool stats for db.
+func registerMetrics(db *sql.DB, dbName string) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, dbName))
+}
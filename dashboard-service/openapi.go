@@ -0,0 +1,89 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+// undocumentedRoutes are operational endpoints left out of the spec.
+var undocumentedRoutes = map[string]bool{
+	"/health":       true,
+	"/openapi.json": true,
+	// Static assets served by r.Static
+	"/static/*filepath": true,
+}
+
+var openAPIMethods = map[string]bool{
+	"get": true, "put": true, "post": true, "delete": true,
+	"options": true, "head": true, "patch": true, "trace": true,
+}
+
+// registerOpenAPI serves the service's OpenAPI 3 document. The API gateway
+// merges these documents into its own /openapi.json.
+func registerOpenAPI(r *gin.Engine) {
+	r.GET("/openapi.json", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/json", openAPISpec)
+	})
+}
+
+// checkOpenAPI reports routes missing from openapi.json and documented
+// operations without a handler.
+func checkOpenAPI(r *gin.Engine) error {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		return fmt.Errorf("parse openapi.json: %w", err)
+	}
+
+	documented := map[string]bool{}
+	for path, item := range spec.Paths {
+		for method := range item {
+			if openAPIMethods[method] {
+				documented[strings.ToUpper(method)+" "+path] = true
+			}
+		}
+	}
+
+	var problems []string
+	for _, route := range r.Routes() {
+		if undocumentedRoutes[route.Path] {
+			continue
+		}
+		key := route.Method + " " + openAPIPath(route.Path)
+		if !documented[key] {
+			problems = append(problems, "undocumented route "+key)
+		}
+		delete(documented, key)
+	}
+	for key := range documented {
+		problems = append(problems, "documented operation without handler "+key)
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// openAPIPath converts gin path parameters (:id, *path) to OpenAPI ({id}).
+func openAPIPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		if strings.HasPrefix(seg, ":") || strings.HasPrefix(seg, "*") {
+			segments[i] = "{" + seg[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -22,12 +22,74 @@ CREATE TABLE users (
     username VARCHAR(50) NOT NULL UNIQUE,
     email VARCHAR(100) NOT NULL UNIQUE,
     password VARCHAR(255) NOT NULL,
+    role ENUM('admin', 'manager', 'member') NOT NULL DEFAULT 'member',
+    -- Tokens issued at or before this time are rejected
+    sessions_revoked_at TIMESTAMP NULL,
+    -- Set when the user confirms the address; NULL until then
+    email_verified_at TIMESTAMP NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+-- API keys for machine clients. Only the SHA-256 of each key is stored;
+-- prefix is kept to help users recognise their keys.
+CREATE TABLE api_keys (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    prefix VARCHAR(16) NOT NULL,
+    key_hash CHAR(64) NOT NULL UNIQUE,
+    scopes VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP NULL,
+    revoked_at TIMESTAMP NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    INDEX idx_api_keys_user (user_id)
+);
+
+-- Individually revoked access tokens, kept until they expire
+CREATE TABLE revoked_tokens (
+    jti CHAR(32) PRIMARY KEY,
+    user_id INT NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    INDEX idx_revoked_tokens_revoked_at (revoked_at),
+    INDEX idx_revoked_tokens_expires_at (expires_at)
+);
+
+-- Single-use refresh tokens. Tokens rotated from the same login share a
+-- family_id; reuse of a spent token revokes the family.
+CREATE TABLE refresh_tokens (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    family_id CHAR(32) NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP NULL,
+    revoked_at TIMESTAMP NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    INDEX idx_refresh_tokens_family (family_id),
+    INDEX idx_refresh_tokens_expires_at (expires_at)
+);
+
+-- Single-use password reset tokens, stored as SHA-256 hashes. Issuing a
+-- new one spends the user's outstanding tokens.
+CREATE TABLE password_resets (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id),
+    INDEX idx_password_resets_user (user_id),
+    INDEX idx_password_resets_expires_at (expires_at)
+);
+
 -- Seed initial data
-INSERT INTO users (username, email, password) VALUES 
-('admin', 'admin@example.com', '$2a$10$g1dHbu4wmGQbvMV9Jqo1Du5d./ix3rhdzzHObnsEBUk/snjFDxC7q');  -- password: admin 
+INSERT INTO users (username, email, password, role, email_verified_at) VALUES 
+('admin', 'admin@example.com', '$2a$10$g1dHbu4wmGQbvMV9Jqo1Du5d./ix3rhdzzHObnsEBUk/snjFDxC7q', 'admin', CURRENT_TIMESTAMP);  -- password: admin 
 
 
 USE task_db;
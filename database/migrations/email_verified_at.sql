@@ -0,0 +1,15 @@
+-- Adds email verification to a database created before it existed. Run it
+-- once against user_db before deploying the services that enforce it; new
+-- databases get the column from init.sql.
+--
+-- Accounts that already exist are treated as verified from the time they were
+-- created, so they can still create tasks, receive assignments and use the
+-- other require_verified routes once their token is next refreshed. Only
+-- accounts registered afterwards have to confirm their address.
+
+USE user_db;
+
+-- Set when the user confirms the address; NULL until then
+ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMP NULL;
+
+UPDATE users SET email_verified_at = created_at WHERE email_verified_at IS NULL;
@@ -4,7 +4,10 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"flag"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"time"
 
@@ -37,10 +40,25 @@ var (
 )
 
 func main() {
+	checkSpec := flag.Bool("check-openapi", false, "verify openapi.json against the registered routes and exit")
+	flag.Parse()
+	setupLogging()
+
+	if *checkSpec {
+		if err := checkOpenAPI(setupRouter()); err != nil {
+			log.Fatalf("openapi.json is out of sync with the routes: %v", err)
+		}
+		log.Println("openapi.json matches the registered routes")
+		return
+	}
+
 	err := godotenv.Load(".env")
 	if err != nil {
 		log.Fatalf("Error loading .env file: %v", err)
 	}
+	if err := loadInternalSecret(); err != nil {
+		log.Fatal(err)
+	}
 
 	// Database connection
 	username := os.Getenv("MYSQL_USER")
@@ -73,16 +91,58 @@ func main() {
 	})
 	defer reader.Close()
 
+	registerMetrics(db, "notification_db")
+
+	stop, deadline := shutdownContexts()
+	go serveMetrics(stop, deadline)
+
 	// Start Kafka message consumption
-	go consumeNotifications()
+	consumerDone := make(chan struct{})
+	go func() {
+		defer close(consumerDone)
+		consumeNotifications(stop, deadline)
+	}()
 
-	// Gin router setup
-	r := gin.Default()
-	r.POST("/api/notifications/send", sendNotification)
+	srv := &http.Server{
+		Addr:              ":8084",
+		Handler:           setupRouter(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Println("Notification service running on :8084")
+	if err := serve(stop, deadline, srv); err != nil {
+		log.Fatalf("Server failed: %v", err)
+	}
+
+	// The consumer stops on the same signal once its current message is done
+	select {
+	case <-consumerDone:
+	case <-deadline.Done():
+		slog.Warn("kafka consumer did not stop before the shutdown deadline")
+	}
+	log.Println("Notification service stopped")
+}
+
+// setupRouter registers the service routes.
+func setupRouter() *gin.Engine {
+	r := newRouter()
+	r.Use(requireInternalToken())
+	r.GET("/health", healthCheck)
+	registerOpenAPI(r)
+	r.POST("/api/notifications/send", invalidates("notifications"), sendNotification)
 	r.GET("/api/notifications/user/:user_id", getUserNotifications)
-	r.PUT("/api/notifications/:id/read", markNotificationAsRead)
+	r.PUT("/api/notifications/:id/read", invalidates("notifications"), markNotificationAsRead)
+
+	return r
+}
 
-	r.Run(":8084")
+// healthCheck reports whether the service can reach its database.
+func healthCheck(c *gin.Context) {
+	if err := db.PingContext(c.Request.Context()); err != nil {
+		c.JSON(503, gin.H{"status": "unavailable", "error": "database unreachable"})
+		return
+	}
+	c.JSON(200, gin.H{"status": "ok"})
 }
 
 func sendNotification(c *gin.Context) {
@@ -99,43 +159,87 @@ func sendNotification(c *gin.Context) {
 		log.Fatalf("Error marshaling event: %v", err)
 	}
 
+	// Carry the request ID so the consumer's logs can be correlated
 	err = writer.WriteMessages(context.Background(),
 		kafka.Message{
 			Value: jsonData,
+			Headers: []kafka.Header{
+				{Key: headerRequestID, Value: []byte(c.GetString(ctxRequestID))},
+			},
 		},
 	)
 
 	if err != nil {
+		c.Error(err)
 		c.JSON(500, gin.H{"error": "Failed to send notification" + err.Error()})
 		return
 	}
+	kafkaMessagesProduced.Inc()
 
 	c.JSON(200, gin.H{"message": "Notification queued"})
 }
 
-func consumeNotifications() {
+// consumeNotifications stores notifications from Kafka until stop is
+// cancelled. Each offset is committed after its message has been handled, so
+// a message interrupted by shutdown is redelivered rather than lost.
+// Messages that fail to decode or store are logged and skipped.
+func consumeNotifications(stop, deadline context.Context) {
 	for {
-		msg, err := reader.ReadMessage(context.Background())
+		msg, err := reader.FetchMessage(stop)
 		if err != nil {
-			log.Printf("Error reading message: %v", err)
+			if stop.Err() != nil {
+				return
+			}
+			kafkaMessagesFailed.WithLabelValues("read").Inc()
+			slog.Error("error reading message", "error", err)
 			continue
 		}
+		kafkaMessagesConsumed.Inc()
 
-		var event NotificationEvent
-		if err := json.Unmarshal(msg.Value, &event); err != nil {
-			log.Printf("Error unmarshaling message: %v", err)
-			continue
+		logger := slog.With(
+			"request_id", messageHeader(msg, headerRequestID),
+			"partition", msg.Partition,
+			"offset", msg.Offset,
+		)
+		handleNotification(logger, msg)
+
+		// Commit even while stopping; only the shutdown deadline cuts it short
+		if err := reader.CommitMessages(deadline, msg); err != nil {
+			kafkaMessagesFailed.WithLabelValues("commit").Inc()
+			logger.Error("error committing offset", "error", err)
 		}
+	}
+}
 
-		// Create notification in database
-		_, err = db.Exec(
-			"INSERT INTO notifications (user_id, message, type, is_read, created_at) VALUES (?, ?, ?, ?, ?)",
-			event.UserID, event.Message, event.EventType, false, time.Now(),
-		)
-		if err != nil {
-			log.Printf("Error saving notification: %v", err)
+func handleNotification(logger *slog.Logger, msg kafka.Message) {
+	var event NotificationEvent
+	if err := json.Unmarshal(msg.Value, &event); err != nil {
+		kafkaMessagesFailed.WithLabelValues("decode").Inc()
+		logger.Error("error unmarshaling message", "error", err)
+		return
+	}
+
+	// Create notification in database
+	_, err := db.Exec(
+		"INSERT INTO notifications (user_id, message, type, is_read, created_at) VALUES (?, ?, ?, ?, ?)",
+		event.UserID, event.Message, event.EventType, false, time.Now(),
+	)
+	if err != nil {
+		kafkaMessagesFailed.WithLabelValues("store").Inc()
+		logger.Error("error saving notification", "user_id", event.UserID, "error", err)
+		return
+	}
+	logger.Info("notification saved", "user_id", event.UserID, "event_type", event.EventType)
+}
+
+// messageHeader returns the value of a Kafka message header, or "".
+func messageHeader(msg kafka.Message, key string) string {
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			return string(h.Value)
 		}
 	}
+	return ""
 }
 
 func getUserNotifications(c *gin.Context) {
@@ -146,6 +250,7 @@ func getUserNotifications(c *gin.Context) {
 		userID,
 	)
 	if err != nil {
+		c.Error(err)
 		c.JSON(500, gin.H{"error": "Failed to retrieve notifications"})
 		return
 	}
@@ -164,6 +269,7 @@ func getUserNotifications(c *gin.Context) {
 			&createdAtbytes,
 		)
 		if err != nil {
+			c.Error(err)
 			c.JSON(500, gin.H{"error": "Failed to scan notification"})
 			return
 		}
@@ -182,6 +288,7 @@ func markNotificationAsRead(c *gin.Context) {
 		notificationID,
 	)
 	if err != nil {
+		c.Error(err)
 		c.JSON(500, gin.H{"error": "Failed to mark notification as read"})
 		return
 	}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "http_request_duration_seconds",
+	Help:    "HTTP request latency by route and status code.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"method", "route", "status"})
+
+var (
+	kafkaMessagesProduced = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "notification_kafka_messages_produced_total",
+		Help: "Notification events published to Kafka.",
+	})
+	kafkaMessagesConsumed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "notification_kafka_messages_consumed_total",
+		Help: "Notification events read from Kafka.",
+	})
+	kafkaMessagesFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notification_kafka_messages_failed_total",
+		Help: "Kafka messages that could not be read, decoded, stored or committed.",
+	}, []string{"reason"})
+)
+
+// metrics records request latency per route template. Unmatched paths share
+// a single label so scanners cannot blow up cardinality.
+func metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequestDuration.
+			WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+// defaultMetricsAddr is where /metrics is served when METRICS_ADDR is not
+// set.
+const defaultMetricsAddr = ":9084"
+
+// serveMetrics serves /metrics on METRICS_ADDR until stop is cancelled.
+func serveMetrics(stop, deadline context.Context) {
+	addr := os.Getenv("METRICS_ADDR")
+	if addr == "" {
+		addr = defaultMetricsAddr
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	slog.Info("metrics listening", "addr", addr)
+	if err := serve(stop, deadline, srv); err != nil {
+		slog.Error("metrics server failed", "error", err)
+	}
+}
+
+// registerMetrics collects connection pool stats for db and
+// the consumer lag of the Kafka reader.
+func registerMetrics(db *sql.DB, dbName string) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, dbName))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "notification_kafka_consumer_lag",
+		Help: "Messages the notification consumer is behind the partition head.",
+	}, func() float64 {
+		return float64(reader.Stats().Lag)
+	}))
+}
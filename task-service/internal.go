@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// headerInternalToken carries the short-lived token the API gateway signs for
+// every request it sends. Requests without one did not come through the
+// gateway and are rejected, so the published ports cannot be used to skip
+// its authentication.
+const headerInternalToken = "X-Internal-Token"
+
+const internalTokenIssuer = "api-gateway"
+
+// minInternalSecret is the shortest INTERNAL_TOKEN_SECRET accepted.
+const minInternalSecret = 32
+
+// Health probes do not go through the gateway. Metrics are served on a
+// separate listener, see serveMetrics.
+var internalTokenExempt = map[string]bool{"/health": true}
+
+// internalSecret is the HMAC key shared with the API gateway.
+var internalSecret []byte
+
+// loadInternalSecret reads INTERNAL_TOKEN_SECRET.
+func loadInternalSecret() error {
+	secret := os.Getenv("INTERNAL_TOKEN_SECRET")
+	if len(secret) < minInternalSecret {
+		return errors.New("INTERNAL_TOKEN_SECRET must be set to at least 32 bytes")
+	}
+	internalSecret = []byte(secret)
+	return nil
+}
+
+// requireInternalToken rejects requests without a valid internal token. A
+// token is only good for the method and path it was signed for.
+func requireInternalToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if internalTokenExempt[c.Request.URL.Path] {
+			c.Next()
+			return
+		}
+
+		claims := jwt.MapClaims{}
+		_, err := jwt.ParseWithClaims(c.GetHeader(headerInternalToken), claims, func(*jwt.Token) (interface{}, error) {
+			return internalSecret, nil
+		}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithIssuer(internalTokenIssuer),
+			jwt.WithExpirationRequired(), jwt.WithLeeway(5*time.Second))
+		if err != nil || len(internalSecret) == 0 ||
+			claims["method"] != c.Request.Method || claims["path"] != c.Request.URL.EscapedPath() {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Requests must go through the API gateway"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// headerCacheInvalidate tells the API gateway which of its cached responses a
+// successful write makes stale.
+const headerCacheInvalidate = "X-Cache-Invalidate"
+
+// invalidates marks a route's responses as changing the data behind the
+// given gateway cache tags. The gateway ignores it on failed requests.
+func invalidates(tags ...string) gin.HandlerFunc {
+	value := strings.Join(tags, ", ")
+	return func(c *gin.Context) {
+		c.Header(headerCacheInvalidate, value)
+		c.Next()
+	}
+}
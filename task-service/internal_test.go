@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func internalToken(t *testing.T, secret []byte, claims jwt.MapClaims) string {
+	t.Helper()
+
+	now := time.Now()
+	base := jwt.MapClaims{
+		"iss":    internalTokenIssuer,
+		"iat":    now.Unix(),
+		"exp":    now.Add(30 * time.Second).Unix(),
+		"method": http.MethodGet,
+		"path":   "/api/tasks/1",
+	}
+	// A nil value removes the claim
+	for k, v := range claims {
+		if v == nil {
+			delete(base, k)
+		} else {
+			base[k] = v
+		}
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, base).SignedString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestRequireInternalToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	internalSecret = []byte(strings.Repeat("s", minInternalSecret))
+	t.Cleanup(func() { internalSecret = nil })
+
+	r := gin.New()
+	r.Use(requireInternalToken())
+	r.GET("/api/tasks/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/health", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{"valid token", http.MethodGet, "/api/tasks/1", internalToken(t, internalSecret, nil), http.StatusOK},
+		{"missing token", http.MethodGet, "/api/tasks/1", "", http.StatusUnauthorized},
+		{"wrong secret", http.MethodGet, "/api/tasks/1", internalToken(t, []byte(strings.Repeat("x", minInternalSecret)), nil), http.StatusUnauthorized},
+		{"wrong issuer", http.MethodGet, "/api/tasks/1", internalToken(t, internalSecret, jwt.MapClaims{"iss": "someone"}), http.StatusUnauthorized},
+		{"expired", http.MethodGet, "/api/tasks/1", internalToken(t, internalSecret, jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}), http.StatusUnauthorized},
+		{"no expiry", http.MethodGet, "/api/tasks/1", internalToken(t, internalSecret, jwt.MapClaims{"exp": nil}), http.StatusUnauthorized},
+		{"signed for another path", http.MethodGet, "/api/tasks/2", internalToken(t, internalSecret, nil), http.StatusUnauthorized},
+		{"signed for another method", http.MethodDelete, "/api/tasks/1", internalToken(t, internalSecret, nil), http.StatusUnauthorized},
+		{"health is exempt", http.MethodGet, "/health", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set(headerInternalToken, tt.token)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
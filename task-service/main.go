@@ -2,9 +2,14 @@ package main
 
 import (
 	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -24,10 +29,25 @@ type Task struct {
 var db *sql.DB
 
 func main() {
+	checkSpec := flag.Bool("check-openapi", false, "verify openapi.json against the registered routes and exit")
+	flag.Parse()
+	setupLogging()
+
+	if *checkSpec {
+		if err := checkOpenAPI(setupRouter()); err != nil {
+			log.Fatalf("openapi.json is out of sync with the routes: %v", err)
+		}
+		log.Println("openapi.json matches the registered routes")
+		return
+	}
+
 	err := godotenv.Load(".env")
 	if err != nil {
 		log.Fatalf("Error loading .env file: %v", err)
 	}
+	if err := loadInternalSecret(); err != nil {
+		log.Fatal(err)
+	}
 
 	// Database connection
 	username := os.Getenv("MYSQL_USER")
@@ -43,25 +63,67 @@ func main() {
 	}
 	defer db.Close()
 
-	r := gin.Default()
+	registerMetrics(db, "task_db")
+
+	stop, deadline := shutdownContexts()
+	go serveMetrics(stop, deadline)
+	srv := &http.Server{
+		Addr:              ":8082",
+		Handler:           setupRouter(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Println("Task service running on :8082")
+	if err := serve(stop, deadline, srv); err != nil {
+		log.Fatalf("Server failed: %v", err)
+	}
+	log.Println("Task service stopped")
+}
+
+// setupRouter registers the service routes.
+func setupRouter() *gin.Engine {
+	r := newRouter()
+	r.Use(requireInternalToken())
+
+	// Health check used by the API gateway
+	r.GET("/health", healthCheck)
+	registerOpenAPI(r)
 
 	// Task creation routes
-	r.POST("/api/tasks", createTask)
+	r.POST("/api/tasks", invalidates("tasks"), createTask)
 	r.GET("/api/tasks", getAllTasks)
 	r.GET("/api/tasks/:id", getTaskByID)
-	r.PUT("/api/tasks/:id", updateTask)
-	r.DELETE("/api/tasks/:id", deleteTask)
+	r.PUT("/api/tasks/:id", invalidates("tasks"), updateTask)
+	r.DELETE("/api/tasks/:id", invalidates("tasks"), deleteTask)
 
-	r.Run(":8082")
+	return r
+}
+
+// healthCheck reports whether the service can reach its database.
+func healthCheck(c *gin.Context) {
+	if err := db.PingContext(c.Request.Context()); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": "database unreachable"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
 
 func createTask(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing user identity"})
+		return
+	}
+
 	var task Task
 	if err := c.BindJSON(&task); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	// The creator is always the authenticated caller
+	task.CreatedBy = userID
+
 	// Set default status if not provided
 	if task.Status == "" {
 		task.Status = "TODO"
@@ -73,6 +135,7 @@ func createTask(c *gin.Context) {
 		task.Title, task.Description, task.Status, task.CreatedBy, time.Now(),
 	)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Task creation failed: "})
 		return
 	}
@@ -85,9 +148,26 @@ func createTask(c *gin.Context) {
 	c.JSON(http.StatusCreated, task)
 }
 
+// getAllTasks lists every task, or only those named by the optional
+// comma-separated ids parameter.
 func getAllTasks(c *gin.Context) {
-	rows, err := db.Query("SELECT id, title, description, status, created_by, created_at FROM tasks")
+	query := "SELECT id, title, description, status, created_by, created_at FROM tasks"
+	var args []any
+	if raw, ok := c.GetQuery("ids"); ok {
+		ids, err := parseIDs(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		query += " WHERE id IN (?" + strings.Repeat(", ?", len(ids)-1) + ")"
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+
+	rows, err := db.Query(query, args...)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve tasks"})
 		return
 	}
@@ -99,6 +179,7 @@ func getAllTasks(c *gin.Context) {
 		var createdAtBytes []byte
 		err := rows.Scan(&task.ID, &task.Title, &task.Description, &task.Status, &task.CreatedBy, &createdAtBytes)
 		if err != nil {
+			c.Error(err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan task"})
 			return
 		}
@@ -119,6 +200,7 @@ func getTaskByID(c *gin.Context) {
 	err := db.QueryRow("SELECT id, title, description, status, created_by, created_at FROM tasks WHERE id = ?", id).
 		Scan(&task.ID, &task.Title, &task.Description, &task.Status, &task.CreatedBy, &createdAtBytes)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusNotFound, gin.H{"error": "Task not found" + err.Error()})
 		return
 	}
@@ -145,6 +227,7 @@ func updateTask(c *gin.Context) {
 		task.Title, task.Description, task.Status, id,
 	)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Task update failed"})
 		return
 	}
@@ -157,9 +240,42 @@ func deleteTask(c *gin.Context) {
 
 	_, err := db.Exec("DELETE FROM tasks WHERE id = ?", id)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Task deletion failed"})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Task deleted successfully"})
 }
+
+// currentUserID returns the caller's ID as forwarded by the API gateway.
+func currentUserID(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.GetHeader("X-User-ID"))
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return id, true
+}
+
+// maxBatchIDs bounds the number of IDs accepted by batch lookups.
+const maxBatchIDs = 100
+
+// parseIDs parses a comma-separated list of positive IDs.
+func parseIDs(s string) ([]int, error) {
+	if s == "" {
+		return nil, errors.New("ids must not be empty")
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) > maxBatchIDs {
+		return nil, fmt.Errorf("at most %d ids are allowed", maxBatchIDs)
+	}
+	ids := make([]int, 0, len(parts))
+	for _, part := range parts {
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("invalid id %q", part)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiKeyPrefix marks keys issued by this service so they are easy to spot in
+// logs and secret scanners.
+const apiKeyPrefix = "tm_"
+
+// maxAPIKeysPerUser bounds the number of active keys a user can hold.
+const maxAPIKeysPerUser = 20
+
+// validScopes lists the permissions an API key can be granted. The API
+// gateway enforces them per route.
+var validScopes = map[string]bool{
+	"users:read":          true,
+	"tasks:read":          true,
+	"tasks:write":         true,
+	"assignments:read":    true,
+	"assignments:write":   true,
+	"notifications:read":  true,
+	"notifications:write": true,
+	"dashboard:read":      true,
+}
+
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+type createAPIKeyRequest struct {
+	Name   string   `json:"name" binding:"required,max=100"`
+	Scopes []string `json:"scopes" binding:"required,min=1"`
+}
+
+// createAPIKey issues a new key for the caller. The plaintext key is only
+// returned here; the database keeps its SHA-256 hash.
+func createAPIKey(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing user identity"})
+		return
+	}
+
+	var req createAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !validScopes[scope] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown scope: " + scope})
+			return
+		}
+	}
+
+	var active int
+	err := db.QueryRow("SELECT COUNT(*) FROM api_keys WHERE user_id = ? AND revoked_at IS NULL", userID).Scan(&active)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+	if active >= maxAPIKeysPerUser {
+		c.JSON(http.StatusConflict, gin.H{"error": "API key limit reached"})
+		return
+	}
+
+	key, err := newSecret(apiKeyPrefix)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+
+	apiKey := APIKey{
+		Name:      req.Name,
+		Prefix:    key[:len(apiKeyPrefix)+8],
+		Scopes:    req.Scopes,
+		CreatedAt: time.Now().UTC(),
+	}
+	result, err := db.Exec("INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		userID, apiKey.Name, apiKey.Prefix, hashSecret(key), strings.Join(apiKey.Scopes, ","), apiKey.CreatedAt)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+	id, _ := result.LastInsertId()
+	apiKey.ID = int(id)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"api_key": apiKey,
+		"key":     key,
+	})
+}
+
+// listAPIKeys returns the caller's keys without their secrets.
+func listAPIKeys(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing user identity"})
+		return
+	}
+
+	rows, err := db.Query(`SELECT id, name, prefix, scopes, created_at, last_used_at, revoked_at
+		FROM api_keys WHERE user_id = ? ORDER BY created_at DESC`, userID)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch API keys"})
+		return
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var key APIKey
+		var scopes string
+		var lastUsed, revoked sql.NullTime
+		if err := rows.Scan(&key.ID, &key.Name, &key.Prefix, &scopes, &key.CreatedAt, &lastUsed, &revoked); err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch API keys"})
+			return
+		}
+		key.Scopes = splitScopes(scopes)
+		if lastUsed.Valid {
+			key.LastUsedAt = &lastUsed.Time
+		}
+		if revoked.Valid {
+			key.RevokedAt = &revoked.Time
+		}
+		keys = append(keys, key)
+	}
+
+	c.JSON(http.StatusOK, keys)
+}
+
+// revokeAPIKey disables one of the caller's keys. Revoked keys are kept so
+// they still show up in the listing.
+func revokeAPIKey(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing user identity"})
+		return
+	}
+
+	keyID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key ID"})
+		return
+	}
+
+	result, err := db.Exec("UPDATE api_keys SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL",
+		time.Now().UTC(), keyID, userID)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
+
+// verifyAPIKey resolves a presented key to its owner, role, scopes and
+// whether the owner's email is verified. It is called by the API gateway and
+// is not routed publicly.
+func verifyAPIKey(c *gin.Context) {
+	var req struct {
+		Key string `json:"key" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var (
+		keyID, userID int
+		role, scopes  string
+		emailVerified bool
+	)
+	err := db.QueryRow(`SELECT k.id, k.user_id, u.role, k.scopes, u.email_verified_at IS NOT NULL
+		FROM api_keys k JOIN users u ON u.id = k.user_id
+		WHERE k.key_hash = ? AND k.revoked_at IS NULL`, hashSecret(req.Key)).
+		Scan(&keyID, &userID, &role, &scopes, &emailVerified)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify API key"})
+		return
+	}
+
+	if _, err := db.Exec("UPDATE api_keys SET last_used_at = ? WHERE id = ?", time.Now().UTC(), keyID); err != nil {
+		c.Error(err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"key_id":         keyID,
+		"user_id":        userID,
+		"roles":          []string{role},
+		"scopes":         splitScopes(scopes),
+		"email_verified": emailVerified,
+	})
+}
+
+// newSecret returns a random 256-bit token with the given prefix.
+func newSecret(prefix string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashSecret returns the hex SHA-256 of an API key or refresh token. They are
+// high-entropy random values, so a fast unsalted hash is enough and allows
+// lookup by hash.
+func hashSecret(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func splitScopes(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+// currentUserID returns the caller's ID as forwarded by the API gateway.
+func currentUserID(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.GetHeader("X-User-ID"))
+	if err != nil || id <= 0 {
+		return 0, false
+	}
+	return id, true
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey is a private key used to sign access tokens. Its kid is taken
+// from the PEM file name.
+type signingKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+}
+
+// keySet holds every key published in the JWKS and the one used for new
+// tokens. Keys stay published after they are rotated out so tokens they
+// signed remain valid until they expire.
+type keySet struct {
+	active *signingKey
+	keys   []*signingKey
+}
+
+var signingKeys *keySet
+
+// loadSigningKeys reads <kid>.pem files (PKCS#8, or PKCS#1 for RSA) from dir
+// and selects activeKID for signing, defaulting to the last kid in sort
+// order. Without a directory an ephemeral Ed25519 key is generated.
+func loadSigningKeys(dir, activeKID string) (*keySet, error) {
+	if dir == "" {
+		key, err := ephemeralKey()
+		if err != nil {
+			return nil, err
+		}
+		slog.Warn("JWT_KEYS_DIR not set, signing with an ephemeral key; tokens will not survive a restart",
+			"kid", key.ID)
+		return &keySet{active: key, keys: []*signingKey{key}}, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	ks := &keySet{}
+	for _, file := range files {
+		key, err := readSigningKey(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		ks.keys = append(ks.keys, key)
+		if key.ID == activeKID {
+			ks.active = key
+		}
+	}
+
+	if len(ks.keys) == 0 {
+		return nil, fmt.Errorf("no signing keys found in %s", dir)
+	}
+	if activeKID == "" {
+		ks.active = ks.keys[len(ks.keys)-1]
+	}
+	if ks.active == nil {
+		return nil, fmt.Errorf("active key %q not found in %s", activeKID, dir)
+	}
+	return ks, nil
+}
+
+func readSigningKey(file string) (*signingKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+
+	var parsed any
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &signingKey{ID: strings.TrimSuffix(filepath.Base(file), ".pem")}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		key.Method, key.Private = jwt.SigningMethodRS256, k
+	case ed25519.PrivateKey:
+		key.Method, key.Private = jwt.SigningMethodEdDSA, k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+	return key, nil
+}
+
+func ephemeralKey() (*signingKey, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &signingKey{ID: "ephemeral-" + hex.EncodeToString(id), Method: jwt.SigningMethodEdDSA, Private: private}, nil
+}
+
+// sign issues a token with the active key, tagged with its kid.
+func (ks *keySet) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.active.Method, claims)
+	token.Header["kid"] = ks.active.ID
+	return token.SignedString(ks.active.Private)
+}
+
+// jwk is a public key in JSON Web Key format (RFC 7517).
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// OKP
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+func (ks *keySet) jwks() []jwk {
+	keys := make([]jwk, 0, len(ks.keys))
+	for _, key := range ks.keys {
+		k := jwk{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+		switch pub := key.Private.Public().(type) {
+		case *rsa.PublicKey:
+			k.Kty = "RSA"
+			k.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			k.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			k.Kty = "OKP"
+			k.Crv = "Ed25519"
+			k.X = base64.RawURLEncoding.EncodeToString(pub)
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// getJWKS publishes the public signing keys for the API gateway.
+func getJWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{"keys": signingKeys.jwks()})
+}
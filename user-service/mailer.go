@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// smtpTimeout bounds a whole SMTP exchange, from dialling to QUIT.
+const smtpTimeout = 30 * time.Second
+
+const defaultMailFrom = "Task Management <no-reply@localhost>"
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers email to users.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// mailer is the Mailer the handlers send through, set up by newMailer.
+var mailer Mailer = logMailer{}
+
+// newMailer sends through SMTP_HOST when it is set, e.g. a local MailHog at
+// 127.0.0.1:1025. Without it mail is only logged.
+func newMailer() (Mailer, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		slog.Warn("SMTP_HOST not set, emails will be logged instead of sent")
+		return logMailer{}, nil
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "25"
+	}
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = defaultMailFrom
+	}
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP_FROM: %w", err)
+	}
+
+	m := &smtpMailer{addr: net.JoinHostPort(host, port), host: host, from: addr}
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		// PlainAuth refuses to send credentials unencrypted except to localhost
+		m.auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return m, nil
+}
+
+// smtpMailer sends mail through an SMTP relay, upgrading to TLS when the
+// server offers STARTTLS.
+type smtpMailer struct {
+	addr string
+	host string
+	from *mail.Address
+	auth smtp.Auth
+}
+
+func (m *smtpMailer) Send(msg Message) error {
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return fmt.Errorf("invalid recipient: %w", err)
+	}
+	if strings.ContainsAny(msg.Subject, "\r\n") {
+		return errors.New("subject must be a single line")
+	}
+
+	conn, err := net.DialTimeout("tcp", m.addr, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+	client, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+			return err
+		}
+	}
+	if m.auth != nil {
+		if err := client.Auth(m.auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(m.from.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to.Address); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(m.format(to, msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// format renders msg with the headers mail clients expect.
+func (m *smtpMailer) format(to *mail.Address, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", m.from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// logMailer stands in when no SMTP server is configured. The body is left
+// out because it usually holds a secret link.
+type logMailer struct{}
+
+func (logMailer) Send(msg Message) error {
+	slog.Info("email not sent, SMTP_HOST is not set", "to", msg.To, "subject", msg.Subject)
+	return nil
+}
@@ -2,12 +2,16 @@ package main
 
 import (
 	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/joho/godotenv"
@@ -19,15 +23,44 @@ type User struct {
 	Username string `json:"username"`
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	Role     string `json:"role"`
+	// EmailVerified is set once the user follows the link emailed at
+	// registration.
+	EmailVerified bool `json:"email_verified"`
 }
 
+// Roles carried in the JWT and enforced by the API gateway.
+const (
+	RoleAdmin   = "admin"
+	RoleManager = "manager"
+	RoleMember  = "member"
+)
+
 var db *sql.DB
 
 func main() {
+	checkSpec := flag.Bool("check-openapi", false, "verify openapi.json against the registered routes and exit")
+	flag.Parse()
+	setupLogging()
+
+	if *checkSpec {
+		if err := checkOpenAPI(setupRouter()); err != nil {
+			log.Fatalf("openapi.json is out of sync with the routes: %v", err)
+		}
+		log.Println("openapi.json matches the registered routes")
+		return
+	}
+
 	err := godotenv.Load(".env")
 	if err != nil {
 		log.Fatalf("Error loading .env file: %v", err)
 	}
+	if err := loadInternalSecret(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadVerificationSecret(); err != nil {
+		log.Fatal(err)
+	}
 
 	// Database connection
 	username := os.Getenv("MYSQL_USER")
@@ -35,7 +68,7 @@ func main() {
 	host := os.Getenv("MYSQL_HOST")
 	port := os.Getenv("MYSQL_PORT")
 
-	dsn := username + ":" + password + "@tcp(" + host + ":" + port + ")/user_db"
+	dsn := username + ":" + password + "@tcp(" + host + ":" + port + ")/user_db?parseTime=true"
 	db, err = sql.Open("mysql", dsn)
 	// db, err = sql.Open("mysql", "root:rootpassword@tcp(mysql:3306)/user_db")
 	if err != nil {
@@ -43,7 +76,37 @@ func main() {
 	}
 	defer db.Close()
 
-	r := gin.Default()
+	signingKeys, err = loadSigningKeys(os.Getenv("JWT_KEYS_DIR"), os.Getenv("JWT_ACTIVE_KID"))
+	if err != nil {
+		log.Fatalf("Failed to load JWT signing keys: %v", err)
+	}
+
+	mailer, err = newMailer()
+	if err != nil {
+		log.Fatalf("Failed to set up mailer: %v", err)
+	}
+
+	registerMetrics(db, "user_db")
+
+	stop, deadline := shutdownContexts()
+	go serveMetrics(stop, deadline)
+	srv := &http.Server{
+		Addr:              ":8081",
+		Handler:           setupRouter(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Println("User service running on :8081")
+	if err := serve(stop, deadline, srv); err != nil {
+		log.Fatalf("Server failed: %v", err)
+	}
+	log.Println("User service stopped")
+}
+
+// setupRouter registers the service routes.
+func setupRouter() *gin.Engine {
+	r := newRouter()
+	r.Use(requireInternalToken())
 
 	// Serve HTML files
 	r.LoadHTMLGlob("templates/*")
@@ -56,15 +119,63 @@ func main() {
 	r.GET("/profile", func(c *gin.Context) {
 		c.HTML(http.StatusOK, "profile.html", nil)
 	})
+	r.GET("/reset-password", func(c *gin.Context) {
+		c.HTML(http.StatusOK, "reset-password.html", nil)
+	})
+	r.GET("/verify-email", func(c *gin.Context) {
+		c.HTML(http.StatusOK, "verify-email.html", nil)
+	})
+
+	// Health check used by the API gateway
+	r.GET("/health", healthCheck)
+	registerOpenAPI(r)
+	// Public keys for verifying access tokens
+	r.GET("/.well-known/jwks.json", getJWKS)
 
 	// User registration
 	r.POST("/api/users/register", registerUser)
 	// User login
 	r.POST("/api/users/login", loginUser)
+	// Exchange a refresh token for new tokens
+	r.POST("/api/users/token/refresh", refreshAccessToken)
+	// Email a password reset link
+	r.POST("/api/users/password/forgot", forgotPassword)
+	// Set a new password with a reset token
+	r.POST("/api/users/password/reset", resetPassword)
+	// Confirm an email address from the emailed link
+	r.POST("/api/users/email/verify", verifyEmail)
+	// Email a new verification link to the caller
+	r.POST("/api/users/email/verify/resend", resendVerification)
 	// Get user profile
 	r.GET("/api/users/profile/:id", getUserProfile)
+	// Get several user profiles at once
+	r.GET("/api/users", getUsersByIDs)
+	// Revoke the current token
+	r.POST("/api/users/logout", logoutUser)
+	// Revoke every token issued to a user (admin)
+	r.DELETE("/api/users/:id/sessions", revokeUserSessions)
+	// Change a user's role (admin)
+	r.PUT("/api/users/:id/role", updateUserRole)
+
+	// API keys for machine clients
+	r.POST("/api/users/api-keys", createAPIKey)
+	r.GET("/api/users/api-keys", listAPIKeys)
+	r.DELETE("/api/users/api-keys/:id", revokeAPIKey)
+	// Key lookup for the API gateway
+	r.POST("/internal/api-keys/verify", verifyAPIKey)
+	// Revocation feed polled by the API gateway
+	r.GET("/internal/revocations", listRevocations)
 
-	r.Run(":8081")
+	return r
+}
+
+// healthCheck reports whether the service can reach its database.
+func healthCheck(c *gin.Context) {
+	if err := db.PingContext(c.Request.Context()); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": "database unreachable"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
 
 func registerUser(c *gin.Context) {
@@ -73,19 +184,29 @@ func registerUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if !validEmail(user.Email) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email address"})
+		return
+	}
 
 	// Hash password
 	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
 
-	// Insert user into database
-	_, err := db.Exec("INSERT INTO users (username, email, password) VALUES (?, ?, ?)",
-		user.Username, user.Email, string(hashedPassword))
+	// Insert user into database. Self-registered accounts are always members
+	// and start unverified; any role supplied in the request body is ignored.
+	result, err := db.Exec("INSERT INTO users (username, email, password, role) VALUES (?, ?, ?, ?)",
+		user.Username, user.Email, string(hashedPassword), RoleMember)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Registration failed" + err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{"message": "User registered successfully"})
+	id, _ := result.LastInsertId()
+	user.ID = int(id)
+	go sendVerification(user)
+
+	c.JSON(http.StatusCreated, gin.H{"message": "User registered successfully; check your email to verify your address"})
 }
 
 func loginUser(c *gin.Context) {
@@ -96,9 +217,10 @@ func loginUser(c *gin.Context) {
 	}
 
 	var user User
-	err := db.QueryRow("SELECT id, username, password FROM users WHERE email = ?", loginUser.Email).
-		Scan(&user.ID, &user.Username, &user.Password)
+	err := db.QueryRow("SELECT id, username, password, role, email_verified_at IS NOT NULL FROM users WHERE email = ?", loginUser.Email).
+		Scan(&user.ID, &user.Username, &user.Password, &user.Role, &user.EmailVerified)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials" + err.Error()})
 		return
 	}
@@ -109,35 +231,154 @@ func loginUser(c *gin.Context) {
 		return
 	}
 
-	// Generate JWT token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id": user.ID,
-		"exp":     time.Now().Add(time.Hour * 24).Unix(),
-	})
-
-	tokenString, err := token.SignedString([]byte(os.Getenv("JWT_SECRET_KEY")))
+	// Each login starts a new refresh token family
+	tokens, err := issueTokens(db, user, newTokenID())
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token generation failed"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"token":    tokenString,
-		"user_id":  user.ID,
-		"username": user.Username,
-	})
+	// Expired refresh tokens are no longer needed for reuse detection
+	if _, err := db.Exec("DELETE FROM refresh_tokens WHERE expires_at < ?", time.Now().UTC()); err != nil {
+		c.Error(err)
+	}
+
+	c.JSON(http.StatusOK, tokens)
 }
 
 func getUserProfile(c *gin.Context) {
 	userID := c.Param("id")
 
 	var user User
-	err := db.QueryRow("SELECT id, username, email FROM users WHERE id = ?", userID).
-		Scan(&user.ID, &user.Username, &user.Email)
+	err := db.QueryRow("SELECT id, username, email, role, email_verified_at IS NOT NULL FROM users WHERE id = ?", userID).
+		Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.EmailVerified)
 	if err != nil {
+		c.Error(err)
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found" + err.Error()})
 		return
 	}
 
 	c.JSON(http.StatusOK, user)
 }
+
+// maxBatchIDs bounds the number of IDs accepted by batch lookups.
+const maxBatchIDs = 100
+
+// getUsersByIDs returns the profiles for a comma-separated list of user IDs.
+// Unknown IDs are left out of the result.
+func getUsersByIDs(c *gin.Context) {
+	ids, err := parseIDs(c.Query("ids"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	rows, err := db.Query("SELECT id, username, email, role, email_verified_at IS NOT NULL FROM users WHERE id IN (?"+strings.Repeat(", ?", len(ids)-1)+")", args...)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
+		return
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.EmailVerified); err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch users"})
+			return
+		}
+		users = append(users, user)
+	}
+
+	c.JSON(http.StatusOK, users)
+}
+
+// updateUserRole changes a user's role. The API gateway restricts it to
+// admins. Tokens carry the role, so a change revokes the user's sessions and
+// the new role applies from their next sign-in.
+func updateUserRole(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	var req struct {
+		Role string `json:"role" binding:"required,oneof=admin manager member"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update role"})
+		return
+	}
+	defer tx.Rollback()
+
+	var user User
+	err = tx.QueryRow("SELECT id, username, email, role, email_verified_at IS NOT NULL FROM users WHERE id = ? FOR UPDATE", userID).
+		Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.EmailVerified)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update role"})
+		return
+	}
+
+	if user.Role == req.Role {
+		c.JSON(http.StatusOK, user)
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE users SET role = ? WHERE id = ?", req.Role, userID); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update role"})
+		return
+	}
+	if _, err := revokeSessions(tx, userID); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update role"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update role"})
+		return
+	}
+
+	user.Role = req.Role
+	c.JSON(http.StatusOK, user)
+}
+
+// parseIDs parses a comma-separated list of positive IDs.
+func parseIDs(s string) ([]int, error) {
+	if s == "" {
+		return nil, errors.New("ids must not be empty")
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) > maxBatchIDs {
+		return nil, fmt.Errorf("at most %d ids are allowed", maxBatchIDs)
+	}
+	ids := make([]int, 0, len(parts))
+	for _, part := range parts {
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("invalid id %q", part)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
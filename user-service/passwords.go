@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordResetTTL is how long a reset link stays usable.
+const passwordResetTTL = time.Hour
+
+const passwordResetPrefix = "tmp_"
+
+const defaultAppURL = "http://localhost:8080"
+
+// appURL is where links in emails point: the API gateway's public address.
+func appURL() string {
+	if u := os.Getenv("APP_URL"); u != "" {
+		return u
+	}
+	return defaultAppURL
+}
+
+// forgotPassword emails a single-use reset link to the account with the given
+// email. The response is the same whether or not the account exists, so it
+// cannot be used to find registered addresses.
+func forgotPassword(c *gin.Context) {
+	var req struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var user User
+	err := db.QueryRow("SELECT id, username, email FROM users WHERE email = ?", req.Email).
+		Scan(&user.ID, &user.Username, &user.Email)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Password reset failed"})
+		return
+	}
+	if err == nil {
+		// Created and sent in the background so the response time does not
+		// reveal whether the account exists
+		go sendPasswordReset(user)
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "If the email is registered, a password reset link has been sent"})
+}
+
+// createPasswordReset stores a new reset token for the user, replacing any
+// outstanding one.
+func createPasswordReset(userID int) (string, error) {
+	token, err := newSecret(passwordResetPrefix)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE password_resets SET used_at = ? WHERE user_id = ? AND used_at IS NULL", now, userID); err != nil {
+		return "", err
+	}
+	_, err = tx.Exec("INSERT INTO password_resets (user_id, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		userID, hashSecret(token), now, now.Add(passwordResetTTL))
+	if err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	// Expired tokens are no longer needed
+	if _, err := db.Exec("DELETE FROM password_resets WHERE expires_at < ?", now); err != nil {
+		slog.Warn("failed to delete expired password resets", "error", err)
+	}
+	return token, nil
+}
+
+// sendPasswordReset emails the user a new reset link. Failures are only
+// logged; the caller has already been answered.
+func sendPasswordReset(user User) {
+	token, err := createPasswordReset(user.ID)
+	if err != nil {
+		slog.Error("failed to create password reset", "user_id", user.ID, "error", err)
+		return
+	}
+
+	link := appURL() + "/reset-password?token=" + url.QueryEscape(token)
+	err = mailer.Send(Message{
+		To:      user.Email,
+		Subject: "Reset your Task Management password",
+		Body: fmt.Sprintf(`Hi %s,
+
+Someone asked to reset the password of your Task Management account. To choose a new password, open this link within %d minutes:
+
+%s
+
+The link works once. If you did not ask for a reset, ignore this email; your password has not been changed.
+`, user.Username, int(passwordResetTTL.Minutes()), link),
+	})
+	if err != nil {
+		slog.Error("failed to send password reset email", "user_id", user.ID, "error", err)
+	}
+}
+
+// resetPassword sets a new password with a token from forgotPassword. Every
+// session of the account is revoked, so a stolen token or password stops
+// working everywhere.
+func resetPassword(c *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+		// bcrypt ignores bytes past the 72nd
+		Password string `json:"password" binding:"required,min=8,max=72"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Password reset failed"})
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Password reset failed"})
+		return
+	}
+	defer tx.Rollback()
+
+	var (
+		userID    int
+		expiresAt time.Time
+		usedAt    sql.NullTime
+	)
+	err = tx.QueryRow("SELECT user_id, expires_at, used_at FROM password_resets WHERE token_hash = ? FOR UPDATE",
+		hashSecret(req.Token)).Scan(&userID, &expiresAt, &usedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Password reset failed"})
+		return
+	}
+	now := time.Now().UTC()
+	if err != nil || usedAt.Valid || now.After(expiresAt) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE users SET password = ? WHERE id = ?", string(hashedPassword), userID); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Password reset failed"})
+		return
+	}
+	if _, err := tx.Exec("UPDATE password_resets SET used_at = ? WHERE user_id = ? AND used_at IS NULL", now, userID); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Password reset failed"})
+		return
+	}
+	if _, err := revokeSessions(tx, userID); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Password reset failed"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Password reset failed"})
+		return
+	}
+
+	slog.Info("password reset", "user_id", userID)
+	c.JSON(http.StatusOK, gin.H{"message": "Password has been reset; log in with the new password"})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// refreshTokenTTL is how long a refresh token can sit unused. Each refresh
+// replaces it with a new one, so active sessions never hit it.
+const refreshTokenTTL = 30 * 24 * time.Hour
+
+const refreshTokenPrefix = "tmr_"
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// signAccessToken issues a short-lived access token for the user.
+func signAccessToken(user User) (string, error) {
+	now := time.Now()
+	return signingKeys.sign(jwt.MapClaims{
+		"user_id":        user.ID,
+		"roles":          []string{user.Role},
+		"email_verified": user.EmailVerified,
+		"jti":            newTokenID(),
+		"iat":            now.Unix(),
+		"exp":            now.Add(accessTokenTTL).Unix(),
+	})
+}
+
+// issueTokens signs an access token and stores a new refresh token in the
+// given family. Tokens rotated from one login share a family, so reuse of
+// any of them can revoke the whole chain.
+func issueTokens(ex execer, user User, familyID string) (gin.H, error) {
+	accessToken, err := signAccessToken(user)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := newSecret(refreshTokenPrefix)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	_, err = ex.Exec("INSERT INTO refresh_tokens (user_id, family_id, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		user.ID, familyID, hashSecret(refreshToken), now, now.Add(refreshTokenTTL))
+	if err != nil {
+		return nil, err
+	}
+
+	return gin.H{
+		"token":          accessToken,
+		"token_type":     "Bearer",
+		"expires_in":     int(accessTokenTTL.Seconds()),
+		"refresh_token":  refreshToken,
+		"user_id":        user.ID,
+		"username":       user.Username,
+		"role":           user.Role,
+		"email_verified": user.EmailVerified,
+	}, nil
+}
+
+// refreshAccessToken exchanges a refresh token for a new access token and a
+// new refresh token. Refresh tokens are single use: presenting one that was
+// already exchanged means it leaked, and the whole family is revoked.
+func refreshAccessToken(c *gin.Context) {
+	var req struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := db.BeginTx(c.Request.Context(), nil)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token refresh failed"})
+		return
+	}
+	defer tx.Rollback()
+
+	var (
+		id        int
+		familyID  string
+		expiresAt time.Time
+		usedAt    sql.NullTime
+		revokedAt sql.NullTime
+		user      User
+	)
+	err = tx.QueryRow(`SELECT r.id, r.family_id, r.expires_at, r.used_at, r.revoked_at,
+			u.id, u.username, u.role, u.email_verified_at IS NOT NULL
+		FROM refresh_tokens r JOIN users u ON u.id = r.user_id
+		WHERE r.token_hash = ? FOR UPDATE`, hashSecret(req.RefreshToken)).
+		Scan(&id, &familyID, &expiresAt, &usedAt, &revokedAt, &user.ID, &user.Username, &user.Role, &user.EmailVerified)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token refresh failed"})
+		return
+	}
+
+	now := time.Now().UTC()
+	if usedAt.Valid && !revokedAt.Valid {
+		if _, err := tx.Exec("UPDATE refresh_tokens SET revoked_at = ? WHERE family_id = ? AND revoked_at IS NULL", now, familyID); err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Token refresh failed"})
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			c.Error(err)
+		}
+		slog.Warn("refresh token reuse detected, revoking token family",
+			"user_id", user.ID,
+			"family_id", familyID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token reuse detected"})
+		return
+	}
+	if revokedAt.Valid || usedAt.Valid || now.After(expiresAt) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE refresh_tokens SET used_at = ? WHERE id = ?", now, id); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token refresh failed"})
+		return
+	}
+	tokens, err := issueTokens(tx, user, familyID)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token refresh failed"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Token refresh failed"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// revokeRefreshFamily revokes the family of a refresh token owned by userID.
+func revokeRefreshFamily(userID int, refreshToken string) error {
+	_, err := db.Exec(`UPDATE refresh_tokens r
+		JOIN refresh_tokens t ON t.family_id = r.family_id
+		SET r.revoked_at = ?
+		WHERE t.token_hash = ? AND t.user_id = ? AND r.revoked_at IS NULL`,
+		time.Now().UTC(), hashSecret(refreshToken), userID)
+	return err
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// defaultShutdownTimeout applies when SHUTDOWN_TIMEOUT is not set. Keep it
+// below the container stop grace period so draining finishes before SIGKILL.
+const defaultShutdownTimeout = 15 * time.Second
+
+// shutdownContexts returns stop, cancelled on SIGINT or SIGTERM, and
+// deadline, cancelled SHUTDOWN_TIMEOUT after stop. Work still running when
+// deadline is cancelled is abandoned.
+func shutdownContexts() (stop, deadline context.Context) {
+	timeout := defaultShutdownTimeout
+	if raw := os.Getenv("SHUTDOWN_TIMEOUT"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			slog.Warn("invalid SHUTDOWN_TIMEOUT, using default", "value", raw, "default", timeout)
+		} else {
+			timeout = d
+		}
+	}
+
+	stop, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	deadline, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop.Done()
+		// A second signal terminates immediately
+		stopSignals()
+		slog.Info("shutting down", "timeout", timeout.String())
+		time.AfterFunc(timeout, cancel)
+	}()
+	return stop, deadline
+}
+
+// serve runs srv until stop is cancelled, then stops accepting connections
+// and waits for in-flight requests until deadline. It returns an error only
+// if the server could not start.
+func serve(stop, deadline context.Context, srv *http.Server) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-stop.Done():
+	}
+
+	if err := srv.Shutdown(deadline); err != nil {
+		slog.Warn("http shutdown deadline exceeded, closing remaining connections", "error", err)
+		srv.Close()
+	}
+	if err := <-errCh; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
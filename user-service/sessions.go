@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// accessTokenTTL is the lifetime of access tokens. Clients renew them with a
+// refresh token. Session revocations older than this no longer affect any
+// valid token.
+const accessTokenTTL = 15 * time.Minute
+
+// Token details forwarded by the API gateway for the bearer token in use
+const (
+	headerTokenID      = "X-Token-ID"
+	headerTokenExpires = "X-Token-Expires"
+)
+
+func newTokenID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// logoutUser revokes the token the request was made with and, when given,
+// the refresh token family of the session.
+func logoutUser(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing user identity"})
+		return
+	}
+
+	jti := c.GetHeader(headerTokenID)
+	exp, err := strconv.ParseInt(c.GetHeader(headerTokenExpires), 10, 64)
+	if jti == "" || err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Logout requires a bearer token"})
+		return
+	}
+
+	// The body is optional
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	c.ShouldBindJSON(&req)
+	if req.RefreshToken != "" {
+		if err := revokeRefreshFamily(userID, req.RefreshToken); err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Logout failed"})
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	_, err = db.Exec("INSERT IGNORE INTO revoked_tokens (jti, user_id, expires_at, revoked_at) VALUES (?, ?, ?, ?)",
+		jti, userID, time.Unix(exp, 0).UTC(), now)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Logout failed"})
+		return
+	}
+
+	// Entries for expired tokens are no longer needed
+	if _, err := db.Exec("DELETE FROM revoked_tokens WHERE expires_at < ?", now); err != nil {
+		c.Error(err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+// revokeUserSessions invalidates every access and refresh token issued to a
+// user so far. The API gateway restricts it to admins.
+func revokeUserSessions(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	found, err := revokeSessions(db, userID)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "All sessions revoked"})
+}
+
+// revokeSessions rejects the user's access tokens issued so far and revokes
+// their refresh tokens. It reports false when the user does not exist.
+func revokeSessions(ex execer, userID int) (bool, error) {
+	// Whole seconds like iat, so MySQL has no fraction to round up and
+	// reject tokens from the next second. Every token issued in the second
+	// of the revoke is rejected; a login that raced it refreshes its token.
+	now := time.Now().UTC().Truncate(time.Second)
+	result, err := ex.Exec("UPDATE users SET sessions_revoked_at = ? WHERE id = ?", now, userID)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	_, err = ex.Exec("UPDATE refresh_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL", now, userID)
+	return err == nil, err
+}
+
+type revokedToken struct {
+	JTI       string `json:"jti"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+type revokedSession struct {
+	UserID    int   `json:"user_id"`
+	RevokedAt int64 `json:"revoked_at"`
+}
+
+// listRevocations returns revocations made since the given Unix time that
+// still affect unexpired tokens. The API gateway polls it to keep its cache
+// current, passing the previous as_of value.
+func listRevocations(c *gin.Context) {
+	since, _ := strconv.ParseInt(c.Query("since"), 10, 64)
+	now := time.Now().UTC()
+	sinceTime := time.Unix(since, 0).UTC()
+
+	tokens := []revokedToken{}
+	rows, err := db.Query("SELECT jti, expires_at FROM revoked_tokens WHERE revoked_at >= ? AND expires_at > ?",
+		sinceTime, now)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch revocations"})
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t revokedToken
+		var expires time.Time
+		if err := rows.Scan(&t.JTI, &expires); err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch revocations"})
+			return
+		}
+		t.ExpiresAt = expires.Unix()
+		tokens = append(tokens, t)
+	}
+
+	sessions := []revokedSession{}
+	rows, err = db.Query("SELECT id, sessions_revoked_at FROM users WHERE sessions_revoked_at >= ? AND sessions_revoked_at > ?",
+		sinceTime, now.Add(-accessTokenTTL))
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch revocations"})
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s revokedSession
+		var revoked time.Time
+		if err := rows.Scan(&s.UserID, &revoked); err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch revocations"})
+			return
+		}
+		s.RevokedAt = revoked.Unix()
+		sessions = append(sessions, s)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"revoked_tokens":   tokens,
+		"revoked_sessions": sessions,
+		"as_of":            now.Unix(),
+	})
+}
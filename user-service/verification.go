@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// emailVerificationTTL is how long a verification link stays usable. A new
+// one can be requested with resendVerification.
+const emailVerificationTTL = 48 * time.Hour
+
+// emailVerificationAudience keeps verification tokens from being mistaken
+// for any other token signed with the same secret.
+const emailVerificationAudience = "email-verification"
+
+// minVerificationSecret is the shortest EMAIL_VERIFICATION_SECRET accepted.
+const minVerificationSecret = 32
+
+// verificationSecret signs verification links.
+var verificationSecret []byte
+
+// loadVerificationSecret reads EMAIL_VERIFICATION_SECRET. Without it a
+// random secret is generated, and links sent before a restart stop working.
+func loadVerificationSecret() error {
+	secret := os.Getenv("EMAIL_VERIFICATION_SECRET")
+	if secret == "" {
+		slog.Warn("EMAIL_VERIFICATION_SECRET not set, verification links will not survive a restart")
+		verificationSecret = make([]byte, minVerificationSecret)
+		_, err := rand.Read(verificationSecret)
+		return err
+	}
+	if len(secret) < minVerificationSecret {
+		return errors.New("EMAIL_VERIFICATION_SECRET must be at least 32 bytes")
+	}
+	verificationSecret = []byte(secret)
+	return nil
+}
+
+// validEmail accepts a bare address such as jane@example.com, without a
+// display name or angle brackets.
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email && len(email) <= 100
+}
+
+// signVerificationToken binds a token to the user and the address being
+// verified, so it stops working if the address changes.
+func signVerificationToken(user User) (string, error) {
+	now := time.Now()
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"aud":   emailVerificationAudience,
+		"sub":   strconv.Itoa(user.ID),
+		"email": user.Email,
+		"iat":   now.Unix(),
+		"exp":   now.Add(emailVerificationTTL).Unix(),
+	}).SignedString(verificationSecret)
+}
+
+// sendVerification emails the user a link to confirm their address.
+func sendVerification(user User) {
+	token, err := signVerificationToken(user)
+	if err != nil {
+		slog.Error("failed to sign email verification token", "user_id", user.ID, "error", err)
+		return
+	}
+	link := appURL() + "/verify-email?token=" + url.QueryEscape(token)
+	err = mailer.Send(Message{
+		To:      user.Email,
+		Subject: "Verify your Task Management email address",
+		Body: fmt.Sprintf(`Hi %s,
+
+Please confirm that this is your email address by opening this link within %d hours:
+
+%s
+
+Until you do, some features such as being assigned tasks are unavailable. If you did not create a Task Management account, ignore this email.
+`, user.Username, int(emailVerificationTTL.Hours()), link),
+	})
+	if err != nil {
+		slog.Error("failed to send email verification", "user_id", user.ID, "error", err)
+	}
+}
+
+// verifyEmail marks the address in a verification link as verified. Tokens
+// issued afterwards carry email_verified; clients refresh theirs to pick it
+// up.
+func verifyEmail(c *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(req.Token, claims, func(*jwt.Token) (interface{}, error) {
+		return verificationSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithAudience(emailVerificationAudience),
+		jwt.WithExpirationRequired())
+	subject, _ := claims.GetSubject()
+	userID, errID := strconv.Atoi(subject)
+	email, _ := claims["email"].(string)
+	if err != nil || errID != nil || email == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification link"})
+		return
+	}
+
+	var verifiedAt sql.NullTime
+	err = db.QueryRow("SELECT email_verified_at FROM users WHERE id = ? AND email = ?", userID, email).Scan(&verifiedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired verification link"})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Email verification failed"})
+		return
+	}
+	if verifiedAt.Valid {
+		c.JSON(http.StatusOK, gin.H{"message": "Email address already verified"})
+		return
+	}
+
+	_, err = db.Exec("UPDATE users SET email_verified_at = ? WHERE id = ? AND email_verified_at IS NULL",
+		time.Now().UTC(), userID)
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Email verification failed"})
+		return
+	}
+
+	slog.Info("email verified", "user_id", userID)
+	c.JSON(http.StatusOK, gin.H{"message": "Email address verified"})
+}
+
+// resendVerification emails a new verification link to the caller.
+func resendVerification(c *gin.Context) {
+	userID, ok := currentUserID(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing user identity"})
+		return
+	}
+
+	var user User
+	err := db.QueryRow("SELECT id, username, email, email_verified_at IS NOT NULL FROM users WHERE id = ?", userID).
+		Scan(&user.ID, &user.Username, &user.Email, &user.EmailVerified)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.Error(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification email"})
+		return
+	}
+	if user.EmailVerified {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email address already verified"})
+		return
+	}
+
+	go sendVerification(user)
+	c.JSON(http.StatusAccepted, gin.H{"message": "Verification email sent"})
+}